@@ -0,0 +1,225 @@
+package fuvaluez
+
+import (
+	"fmt"
+
+	"github.com/anssihalmeaho/funl/funl"
+)
+
+// reducer computes one result from values of group
+type reducer struct {
+	name    string
+	op      string       // 'count', 'sum', 'min', 'max' or 'avg'
+	keyPath []funl.Value // field of value (nil for counting values)
+}
+
+// aggregateOptions are options given for aggregate
+type aggregateOptions struct {
+	selector *valueSelector // nil means all values
+	groupBy  []funl.Value   // nil means all values are in one group
+	reducers []reducer      // nil means count of values
+}
+
+func parseAggregateOptions(frame *funl.Frame, optsVal funl.Value) (*aggregateOptions, error) {
+	opts := &aggregateOptions{}
+	err := forOptions(frame, optsVal, func(keyStr string, valv funl.Value) error {
+		switch keyStr {
+		case "filter":
+			selector, err := newValueSelector(frame, valv)
+			if err != nil {
+				return fmt.Errorf("%s: %v", keyStr, err)
+			}
+			opts.selector = selector
+		case "group-by":
+			opts.groupBy = keyPathFromValue(valv)
+		case "reducers":
+			if valv.Kind != funl.MapValue {
+				return fmt.Errorf("%s value not map: %v", keyStr, valv)
+			}
+			return forOptions(frame, valv, func(resultName string, spec funl.Value) error {
+				r, err := newReducer(resultName, spec)
+				if err != nil {
+					return err
+				}
+				opts.reducers = append(opts.reducers, r)
+				return nil
+			})
+		default:
+			return fmt.Errorf("unknown option: %s", keyStr)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return opts, nil
+}
+
+// newReducer makes reducer from specification which is either
+// operator name ('count') or list of operator name and key path
+func newReducer(name string, spec funl.Value) (reducer, error) {
+	r := reducer{name: name}
+	if spec.Kind == funl.ListValue {
+		parts := listValues(spec)
+		if len(parts) != 2 {
+			return r, fmt.Errorf("invalid reducer: %v", spec)
+		}
+		spec = parts[0]
+		r.keyPath = keyPathFromValue(parts[1])
+	}
+	op, isString := spec.Data.(string)
+	if !isString {
+		return r, fmt.Errorf("invalid reducer: %v", spec)
+	}
+	switch op {
+	case "count":
+	case "sum", "min", "max", "avg":
+		if r.keyPath == nil {
+			return r, fmt.Errorf("key path needed for %s", op)
+		}
+	default:
+		return r, fmt.Errorf("unknown reducer: %s", op)
+	}
+	r.op = op
+	return r, nil
+}
+
+// reducerState is intermediate result of reducer
+type reducerState struct {
+	count    int
+	intSum   int
+	floatSum float64
+	isFloat  bool
+	best     *funl.Value // min/max found so far
+}
+
+func (r *reducer) add(frame *funl.Frame, state *reducerState, val funl.Value) {
+	fieldVal := val
+	if r.keyPath != nil {
+		var found bool
+		if fieldVal, found = getByPath(frame, val, r.keyPath); !found {
+			return
+		}
+	}
+	switch r.op {
+	case "count":
+		state.count++
+	case "sum", "avg":
+		if !isNumber(fieldVal) {
+			return
+		}
+		state.count++
+		if fieldVal.Kind == funl.FloatValue {
+			state.isFloat = true
+			state.floatSum += fieldVal.Data.(float64)
+		} else {
+			state.intSum += fieldVal.Data.(int)
+		}
+	case "min", "max":
+		if !isNumber(fieldVal) && fieldVal.Kind != funl.StringValue {
+			return
+		}
+		state.count++
+		if state.best != nil {
+			cmp := compareValues(fieldVal, *state.best)
+			if (r.op == "min" && cmp >= 0) || (r.op == "max" && cmp <= 0) {
+				return
+			}
+		}
+		best := fieldVal
+		state.best = &best
+	}
+}
+
+// result returns result of reducer, false is returned if there's no result
+// (no values for min/max/avg)
+func (r *reducer) result(state *reducerState) (funl.Value, bool) {
+	switch r.op {
+	case "count":
+		return funl.Value{Kind: funl.IntValue, Data: state.count}, true
+	case "sum":
+		if state.isFloat {
+			return funl.Value{Kind: funl.FloatValue, Data: state.floatSum + float64(state.intSum)}, true
+		}
+		return funl.Value{Kind: funl.IntValue, Data: state.intSum}, true
+	case "avg":
+		if state.count == 0 {
+			return funl.Value{}, false
+		}
+		return funl.Value{Kind: funl.FloatValue, Data: (state.floatSum + float64(state.intSum)) / float64(state.count)}, true
+	}
+	if state.best == nil {
+		return funl.Value{}, false
+	}
+	return *state.best, true
+}
+
+// aggregateGroup is group of values with states of reducers
+type aggregateGroup struct {
+	key    funl.Value
+	states []reducerState
+}
+
+// run computes results, if there's no grouping result of single group is returned
+// otherwise map of group key to result of group,
+// result is count of values or map of reducer results (if reducers are given)
+func (opts *aggregateOptions) run(frame *funl.Frame, items map[string]funl.Value, indexes map[string]*colIndex) (funl.Value, error) {
+	items, err := opts.selector.selectItems(frame, items, indexes)
+	if err != nil {
+		return funl.Value{}, err
+	}
+	reducers := opts.reducers
+	if reducers == nil {
+		reducers = []reducer{{op: "count"}}
+	}
+
+	groups := make(map[string]*aggregateGroup)
+	for _, v := range items {
+		var groupKey funl.Value
+		var keyStr string
+		if opts.groupBy != nil {
+			var found, keyOK bool
+			if groupKey, found = getByPath(frame, v, opts.groupBy); !found {
+				continue
+			}
+			if keyStr, keyOK = valueKey(frame, groupKey); !keyOK {
+				continue
+			}
+		}
+		group, found := groups[keyStr]
+		if !found {
+			group = &aggregateGroup{key: groupKey, states: make([]reducerState, len(reducers))}
+			groups[keyStr] = group
+		}
+		for i := range reducers {
+			reducers[i].add(frame, &group.states[i], v)
+		}
+	}
+
+	groupResult := func(group *aggregateGroup) funl.Value {
+		if opts.reducers == nil {
+			result, _ := reducers[0].result(&group.states[0])
+			return result
+		}
+		var mapItems []*funl.Item
+		for i := range reducers {
+			if result, hasResult := reducers[i].result(&group.states[i]); hasResult {
+				mapItems = append(mapItems, strItem(reducers[i].name), valItem(result))
+			}
+		}
+		return funl.HandleMapOP(frame, mapItems)
+	}
+
+	if opts.groupBy == nil {
+		group, found := groups[""]
+		if !found {
+			group = &aggregateGroup{states: make([]reducerState, len(reducers))}
+		}
+		return groupResult(group), nil
+	}
+	var mapItems []*funl.Item
+	for _, group := range groups {
+		mapItems = append(mapItems, valItem(group.key), valItem(groupResult(group)))
+	}
+	return funl.HandleMapOP(frame, mapItems), nil
+}
@@ -2,7 +2,6 @@ package fuvaluez
 
 import (
 	"fmt"
-	"strconv"
 
 	"github.com/anssihalmeaho/funl/funl"
 )
@@ -141,9 +140,143 @@ func GetVZView(name string) FZProc {
 	}
 }
 
-func GetVZTrans(name string) FZProc {
+func GetVZAddDBListener(name string) FZProc {
+	checkValidity := func(arguments []funl.Value) (bool, string) {
+		if l := len(arguments); l != 2 && l != 3 {
+			return false, fmt.Sprintf("%s: wrong amount of arguments (%d), need two or three", name, l)
+		}
+		if arguments[0].Kind != funl.OpaqueValue {
+			return false, fmt.Sprintf("%s: requires opaque value", name)
+		}
+		if arguments[1].Kind != funl.FunctionValue {
+			return false, fmt.Sprintf("%s: requires func/proc value", name)
+		}
+		return true, ""
+	}
+
+	return func(frame *funl.Frame, arguments []funl.Value) (retVal funl.Value) {
+		ok, errStr := checkValidity(arguments)
+		if !ok {
+			funl.RunTimeError2(frame, errStr)
+		}
+		dbVal, isDB := arguments[0].Data.(*OpaqueDB)
+		if !isDB || dbVal.dbEvents == nil {
+			funl.RunTimeError2(frame, "%s: assuming db value", name)
+		}
+		var l *dbListener
+		if len(arguments) > 2 {
+			var err error
+			if l, err = parseDBListenerOptions(frame, arguments[2]); err != nil {
+				funl.RunTimeError2(frame, "%s: %v", name, err)
+			}
+		}
+		dbVal.dbEvents.addListener(arguments[1], l)
+		retVal = funl.Value{Kind: funl.BoolValue, Data: true}
+		return
+	}
+}
+
+func GetVZSetListenerErrorHandler(name string) FZProc {
+	checkValidity := func(arguments []funl.Value) (bool, string) {
+		if l := len(arguments); l != 2 {
+			return false, fmt.Sprintf("%s: wrong amount of arguments (%d), need two", name, l)
+		}
+		if arguments[0].Kind != funl.OpaqueValue {
+			return false, fmt.Sprintf("%s: requires opaque value", name)
+		}
+		if arguments[1].Kind != funl.FunctionValue {
+			return false, fmt.Sprintf("%s: requires func/proc value", name)
+		}
+		return true, ""
+	}
+
+	return func(frame *funl.Frame, arguments []funl.Value) (retVal funl.Value) {
+		ok, errStr := checkValidity(arguments)
+		if !ok {
+			funl.RunTimeError2(frame, errStr)
+		}
+		dbVal, isDB := arguments[0].Data.(*OpaqueDB)
+		if !isDB {
+			funl.RunTimeError2(frame, "%s: assuming db value", name)
+		}
+		dbVal.Lock()
+		dbVal.listenerErrHandler = &funl.Item{Type: funl.ValueItem, Data: arguments[1]}
+		dbVal.Unlock()
+		retVal = funl.Value{Kind: funl.BoolValue, Data: true}
+		return
+	}
+}
+
+func GetVZDBView(name string) FZProc {
+	checkValidity := func(arguments []funl.Value) (bool, string) {
+		if l := len(arguments); l != 2 {
+			return false, fmt.Sprintf("%s: wrong amount of arguments (%d)", name, l)
+		}
+		if arguments[0].Kind != funl.OpaqueValue {
+			return false, fmt.Sprintf("%s: requires opaque value", name)
+		}
+		if arguments[1].Kind != funl.FunctionValue {
+			return false, fmt.Sprintf("%s: requires func/proc value", name)
+		}
+		return true, ""
+	}
+
+	return func(frame *funl.Frame, arguments []funl.Value) (retVal funl.Value) {
+		ok, errStr := checkValidity(arguments)
+		if !ok {
+			funl.RunTimeError2(frame, errStr)
+		}
+		dbVal, isDB := arguments[0].Data.(*OpaqueDB)
+		if !isDB {
+			funl.RunTimeError2(frame, "%s: assuming db value", name)
+		}
+		var err error
+		retVal, err = runDBView(frame, dbVal, arguments[1])
+		if err != nil {
+			funl.RunTimeError2(frame, "%s: %v", name, err)
+		}
+		return
+	}
+}
+
+func GetVZJoin(name string) FZProc {
 	checkValidity := func(arguments []funl.Value) (bool, string) {
 		if l := len(arguments); l != 2 {
+			return false, fmt.Sprintf("%s: wrong amount of arguments (%d), need two", name, l)
+		}
+		if arguments[0].Kind != funl.OpaqueValue {
+			return false, fmt.Sprintf("%s: requires opaque value", name)
+		}
+		if arguments[1].Kind != funl.MapValue {
+			return false, fmt.Sprintf("%s: requires map value", name)
+		}
+		return true, ""
+	}
+
+	return func(frame *funl.Frame, arguments []funl.Value) (retVal funl.Value) {
+		ok, errStr := checkValidity(arguments)
+		if !ok {
+			funl.RunTimeError2(frame, errStr)
+		}
+		dbVal, isDB := arguments[0].Data.(*OpaqueDB)
+		if !isDB {
+			funl.RunTimeError2(frame, "%s: assuming db value", name)
+		}
+		opts, err := parseJoinOptions(frame, arguments[1])
+		if err != nil {
+			funl.RunTimeError2(frame, "%s: %v", name, err)
+		}
+		retVal, err = runJoin(frame, dbVal, opts)
+		if err != nil {
+			funl.RunTimeError2(frame, "%s: %v", name, err)
+		}
+		return
+	}
+}
+
+func GetVZTrans(name string) FZProc {
+	checkValidity := func(arguments []funl.Value) (bool, string) {
+		if l := len(arguments); l != 2 && l != 3 {
 			return false, fmt.Sprintf("%s: wrong amount of arguments (%d)", name, l)
 		}
 		if arguments[0].Kind != funl.OpaqueValue {
@@ -152,6 +285,9 @@ func GetVZTrans(name string) FZProc {
 		if arguments[1].Kind != funl.FunctionValue {
 			return false, fmt.Sprintf("%s: requires func/proc value", name)
 		}
+		if len(arguments) > 2 && arguments[2].Kind != funl.MapValue {
+			return false, fmt.Sprintf("%s: requires map value", name)
+		}
 		return true, ""
 	}
 
@@ -167,6 +303,13 @@ func GetVZTrans(name string) FZProc {
 				funl.RunTimeError2(frame, "%s: invalid col", name)
 			}
 		}
+		var opts transOptions
+		if len(arguments) > 2 {
+			var err error
+			if opts, err = parseTransOptions(frame, arguments[2]); err != nil {
+				funl.RunTimeError2(frame, "%s: %v", name, err)
+			}
+		}
 		replyCh := make(chan funl.Value)
 		errCh := make(chan string)
 		request := &req{
@@ -175,10 +318,13 @@ func GetVZTrans(name string) FZProc {
 			replyCh: replyCh,
 			errCh:   errCh,
 			frame:   frame,
+			tag:     opts.tag,
 		}
 		col.ch <- *request
 		select {
-		case retVal = <-replyCh:
+		case reply := <-replyCh:
+			committed := listValues(reply)
+			retVal = opts.transResult(frame, committed[0].Data.(bool), committed[1].Data.(string))
 		case retErr := <-errCh:
 			funl.RunTimeError2(frame, retErr)
 		}
@@ -186,6 +332,64 @@ func GetVZTrans(name string) FZProc {
 	}
 }
 
+func GetVZDBTrans(name string) FZProc {
+	checkValidity := func(arguments []funl.Value) (bool, string) {
+		if l := len(arguments); l != 3 && l != 4 {
+			return false, fmt.Sprintf("%s: wrong amount of arguments (%d), need three or four", name, l)
+		}
+		if arguments[0].Kind != funl.OpaqueValue {
+			return false, fmt.Sprintf("%s: requires opaque value", name)
+		}
+		if arguments[1].Kind != funl.ListValue {
+			return false, fmt.Sprintf("%s: requires list value", name)
+		}
+		if arguments[2].Kind != funl.FunctionValue {
+			return false, fmt.Sprintf("%s: requires func/proc value", name)
+		}
+		if len(arguments) > 3 && arguments[3].Kind != funl.MapValue {
+			return false, fmt.Sprintf("%s: requires map value", name)
+		}
+		return true, ""
+	}
+
+	return func(frame *funl.Frame, arguments []funl.Value) (retVal funl.Value) {
+		ok, errStr := checkValidity(arguments)
+		if !ok {
+			funl.RunTimeError2(frame, errStr)
+		}
+		dbVal, isDB := arguments[0].Data.(*OpaqueDB)
+		if !isDB {
+			funl.RunTimeError2(frame, "%s: assuming db value", name)
+		}
+		var colNames []string
+		lit := funl.NewListIterator(arguments[1])
+		for {
+			nextv := lit.Next()
+			if nextv == nil {
+				break
+			}
+			if nextv.Kind != funl.StringValue {
+				funl.RunTimeError2(frame, "%s: col name not a string: %v", name, *nextv)
+			}
+			colNames = append(colNames, nextv.Data.(string))
+		}
+
+		var opts transOptions
+		if len(arguments) > 3 {
+			var err error
+			if opts, err = parseTransOptions(frame, arguments[3]); err != nil {
+				funl.RunTimeError2(frame, "%s: %v", name, err)
+			}
+		}
+		committed, failText, err := runDBTrans(frame, dbVal, colNames, arguments[2], opts.tag)
+		if err != nil {
+			funl.RunTimeError2(frame, "%s: %v", name, err)
+		}
+		retVal = opts.transResult(frame, committed, failText)
+		return
+	}
+}
+
 func GetVZUpdate(name string) FZProc {
 	checkValidity := func(arguments []funl.Value) (bool, string) {
 		if l := len(arguments); l != 2 {
@@ -219,19 +423,9 @@ func GetVZUpdate(name string) FZProc {
 			}
 			newMap := make(map[string]funl.Value)
 			newUpd := make(map[string]funl.Value)
-			m := make(map[string]funl.Value)
 
 			txn.RLock()
-			for k, v := range txn.col.Items {
-				if !txn.newDeleted[k] {
-					m[k] = v
-				}
-			}
-			for k, v := range txn.newM {
-				if !txn.newDeleted[k] {
-					m[k] = v
-				}
-			}
+			m := txn.contents()
 			txn.RUnlock()
 
 			var isAnyUpdates bool
@@ -262,6 +456,7 @@ func GetVZUpdate(name string) FZProc {
 				txn.newM = newMap
 				for k, v := range newUpd {
 					txn.newUPD[k] = v
+					txn.noteKey(frame, k, v)
 				}
 				txn.InvalidateList()
 				txn.Unlock()
@@ -297,8 +492,8 @@ func GetVZTakeValues(name string) FZProc {
 		if arguments[0].Kind != funl.OpaqueValue {
 			return false, fmt.Sprintf("%s: requires opaque value", name)
 		}
-		if arguments[1].Kind != funl.FunctionValue {
-			return false, fmt.Sprintf("%s: requires func/proc value", name)
+		if arguments[1].Kind != funl.FunctionValue && arguments[1].Kind != funl.MapValue {
+			return false, fmt.Sprintf("%s: requires func/proc or map value", name)
 		}
 		return true, ""
 	}
@@ -312,6 +507,13 @@ func GetVZTakeValues(name string) FZProc {
 		if (col == nil) && (txn == nil) {
 			funl.RunTimeError2(frame, "invalid col")
 		}
+		var pattern *valuePattern
+		if arguments[1].Kind == funl.MapValue {
+			var err error
+			if pattern, err = parsePattern(frame, arguments[1]); err != nil {
+				funl.RunTimeError2(frame, "%s: %v", name, err)
+			}
+		}
 		if isTxn {
 			if txn.isReadTxn {
 				funl.RunTimeError2(frame, "%s: not allowed in read txn", name)
@@ -323,20 +525,14 @@ func GetVZTakeValues(name string) FZProc {
 			var takenIDs []string
 			var results []funl.Value
 
-			m := make(map[string]funl.Value)
 			txn.RLock()
-			for k, v := range txn.col.Items {
-				if !txn.newDeleted[k] {
-					m[k] = v
-				}
-			}
-			for k, v := range txn.newM {
-				if !txn.newDeleted[k] {
-					m[k] = v
-				}
-			}
+			m := txn.contents()
 			txn.RUnlock()
 
+			if pattern != nil {
+				takenIDs, results = pattern.selectItems(frame, m, nil)
+				m = nil
+			}
 			for k, v := range m {
 				argsForCall := []*funl.Item{
 					filterFunc,
@@ -373,6 +569,7 @@ func GetVZTakeValues(name string) FZProc {
 			replyCh: replyCh,
 			errCh:   errCh,
 			frame:   frame,
+			pattern: pattern,
 		}
 		col.ch <- *request
 		select {
@@ -384,10 +581,60 @@ func GetVZTakeValues(name string) FZProc {
 	}
 }
 
-func GetVZGetValues(name string) FZProc {
+func GetVZWaitTake(name string) FZProc {
 	checkValidity := func(arguments []funl.Value) (bool, string) {
-		if l := len(arguments); l != 2 {
-			return false, fmt.Sprintf("%s: wrong amount of arguments (%d)", name, l)
+		if l := len(arguments); l != 3 {
+			return false, fmt.Sprintf("%s: wrong amount of arguments (%d), need three", name, l)
+		}
+		if arguments[0].Kind != funl.OpaqueValue {
+			return false, fmt.Sprintf("%s: requires opaque value", name)
+		}
+		if arguments[1].Kind != funl.FunctionValue {
+			return false, fmt.Sprintf("%s: requires func/proc value", name)
+		}
+		if arguments[2].Kind != funl.IntValue {
+			return false, fmt.Sprintf("%s: requires int value", name)
+		}
+		return true, ""
+	}
+
+	return func(frame *funl.Frame, arguments []funl.Value) (retVal funl.Value) {
+		ok, errStr := checkValidity(arguments)
+		if !ok {
+			funl.RunTimeError2(frame, errStr)
+		}
+		isTxn, col, txn := getColAndTxn(arguments[0])
+		if (col == nil) && (txn == nil) {
+			funl.RunTimeError2(frame, "%s: invalid col", name)
+		}
+		if isTxn {
+			funl.RunTimeError2(frame, "%s: not allowed in txn", name)
+		}
+		timeout := arguments[2].Data.(int)
+
+		replyCh := make(chan funl.Value, 1)
+		errCh := make(chan string, 1)
+		request := &req{
+			reqType: waitTakeReq,
+			reqData: arguments[1],
+			replyCh: replyCh,
+			errCh:   errCh,
+			frame:   frame,
+			timeout: timeout,
+		}
+		col.ch <- *request
+		retVal, errText := waitForReply(frame, col, replyCh, errCh, timeout)
+		if errText != "" {
+			funl.RunTimeError2(frame, "%s: %s", name, errText)
+		}
+		return
+	}
+}
+
+func GetVZAwait(name string) FZProc {
+	checkValidity := func(arguments []funl.Value) (bool, string) {
+		if l := len(arguments); l != 3 {
+			return false, fmt.Sprintf("%s: wrong amount of arguments (%d), need three", name, l)
 		}
 		if arguments[0].Kind != funl.OpaqueValue {
 			return false, fmt.Sprintf("%s: requires opaque value", name)
@@ -395,6 +642,63 @@ func GetVZGetValues(name string) FZProc {
 		if arguments[1].Kind != funl.FunctionValue {
 			return false, fmt.Sprintf("%s: requires func/proc value", name)
 		}
+		if arguments[2].Kind != funl.IntValue {
+			return false, fmt.Sprintf("%s: requires int value", name)
+		}
+		return true, ""
+	}
+
+	return func(frame *funl.Frame, arguments []funl.Value) (retVal funl.Value) {
+		ok, errStr := checkValidity(arguments)
+		if !ok {
+			funl.RunTimeError2(frame, errStr)
+		}
+		isTxn, col, txn := getColAndTxn(arguments[0])
+		if (col == nil) && (txn == nil) {
+			funl.RunTimeError2(frame, "%s: invalid col", name)
+		}
+		if isTxn {
+			funl.RunTimeError2(frame, "%s: not allowed in txn", name)
+		}
+		timeout := arguments[2].Data.(int)
+
+		replyCh := make(chan funl.Value, 1)
+		errCh := make(chan string, 1)
+		request := &req{
+			reqType: awaitReq,
+			reqData: arguments[1],
+			replyCh: replyCh,
+			errCh:   errCh,
+			frame:   frame,
+			timeout: timeout,
+		}
+		col.ch <- *request
+		retVal, errText := waitForReply(frame, col, replyCh, errCh, timeout)
+		if errText != "" {
+			funl.RunTimeError2(frame, "%s: %s", name, errText)
+		}
+		if retVal.Kind != funl.BoolValue {
+			// col was closed
+			retVal = funl.Value{Kind: funl.BoolValue, Data: false}
+		}
+		return
+	}
+}
+
+func GetVZGetValues(name string) FZProc {
+	checkValidity := func(arguments []funl.Value) (bool, string) {
+		if l := len(arguments); l != 2 && l != 3 {
+			return false, fmt.Sprintf("%s: wrong amount of arguments (%d)", name, l)
+		}
+		if arguments[0].Kind != funl.OpaqueValue {
+			return false, fmt.Sprintf("%s: requires opaque value", name)
+		}
+		if arguments[1].Kind != funl.FunctionValue && arguments[1].Kind != funl.MapValue {
+			return false, fmt.Sprintf("%s: requires func/proc or map value", name)
+		}
+		if len(arguments) > 2 && arguments[2].Kind != funl.MapValue {
+			return false, fmt.Sprintf("%s: requires map value", name)
+		}
 		return true, ""
 	}
 
@@ -407,6 +711,44 @@ func GetVZGetValues(name string) FZProc {
 		if (col == nil) && (txn == nil) {
 			funl.RunTimeError2(frame, "%s: invalid col", name)
 		}
+		opts := &getOptions{}
+		if len(arguments) > 2 {
+			var err error
+			if opts, err = parseGetOptions(frame, arguments[2]); err != nil {
+				funl.RunTimeError2(frame, "%s: %v", name, err)
+			}
+		}
+		fields := opts.fields
+		if arguments[1].Kind == funl.MapValue || opts.ordered {
+			selector, err := newValueSelector(frame, arguments[1])
+			if err != nil {
+				funl.RunTimeError2(frame, "%s: %v", name, err)
+			}
+			var results []funl.Value
+			func() {
+				var orderIDs []string
+				if isTxn {
+					txn.RLock()
+					defer txn.RUnlock()
+					if opts.ordered {
+						orderIDs = txn.orderedIDs()
+					}
+					results, err = selectValues(frame, selector, txn.contents(), txn.contentIndexes(), orderIDs)
+					return
+				}
+				col.RLock()
+				defer col.RUnlock()
+				if opts.ordered {
+					orderIDs = col.order.ids
+				}
+				results, err = selectValues(frame, selector, col.visibleItems(), col.indexes, orderIDs)
+			}()
+			if err != nil {
+				funl.RunTimeError2(frame, "%s: %v", name, err)
+			}
+			retVal = funl.MakeListOfValues(frame, fields.applyAll(frame, results))
+			return
+		}
 		filterFunc := &funl.Item{
 			Type: funl.ValueItem,
 			Data: arguments[1],
@@ -436,22 +778,12 @@ func GetVZGetValues(name string) FZProc {
 						}
 					}
 				}()
-				retVal = funl.MakeListOfValues(frame, results)
+				retVal = funl.MakeListOfValues(frame, fields.applyAll(frame, results))
 				return
 			}
 			// write transaction
-			m := make(map[string]funl.Value)
 			txn.RLock()
-			for k, v := range txn.col.Items {
-				if !txn.newDeleted[k] {
-					m[k] = v
-				}
-			}
-			for k, v := range txn.newM {
-				if !txn.newDeleted[k] {
-					m[k] = v
-				}
-			}
+			m := txn.contents()
 			txn.RUnlock()
 			for _, v := range m {
 				argsForCall := []*funl.Item{
@@ -469,7 +801,7 @@ func GetVZGetValues(name string) FZProc {
 					results = append(results, v)
 				}
 			}
-			retVal = funl.MakeListOfValues(frame, results)
+			retVal = funl.MakeListOfValues(frame, fields.applyAll(frame, results))
 			return
 		}
 		// not in transaction/view
@@ -477,7 +809,7 @@ func GetVZGetValues(name string) FZProc {
 			col.RLock()
 			defer col.RUnlock()
 
-			for _, v := range col.Items {
+			for _, v := range col.visibleItems() {
 				argsForCall := []*funl.Item{
 					filterFunc,
 					{
@@ -494,32 +826,863 @@ func GetVZGetValues(name string) FZProc {
 				}
 			}
 		}()
-		retVal = funl.MakeListOfValues(frame, results)
+		retVal = funl.MakeListOfValues(frame, fields.applyAll(frame, results))
 		return
 	}
 }
 
-func getColAndTxn(val funl.Value) (isTxn bool, col *OpaqueCol, txn *OpaqueTxn) {
-	var convOK bool
-	txn, convOK = val.Data.(*OpaqueTxn)
-	if convOK {
-		return true, nil, txn
-	}
-	col, convOK = val.Data.(*OpaqueCol)
-	if convOK {
-		return false, col, nil
-	}
-	return false, nil, nil
-}
+func GetVZQuery(name string) FZProc {
+	checkValidity := func(arguments []funl.Value) (bool, string) {
+		if l := len(arguments); l != 2 {
+			return false, fmt.Sprintf("%s: wrong amount of arguments (%d), need two", name, l)
+		}
+		if arguments[0].Kind != funl.OpaqueValue {
+			return false, fmt.Sprintf("%s: requires opaque value", name)
+		}
+		if arguments[1].Kind != funl.MapValue {
+			return false, fmt.Sprintf("%s: requires map value", name)
+		}
+		return true, ""
+	}
+
+	return func(frame *funl.Frame, arguments []funl.Value) (retVal funl.Value) {
+		ok, errStr := checkValidity(arguments)
+		if !ok {
+			funl.RunTimeError2(frame, errStr)
+		}
+		isTxn, col, txn := getColAndTxn(arguments[0])
+		if (col == nil) && (txn == nil) {
+			funl.RunTimeError2(frame, "%s: invalid col", name)
+		}
+		q, err := parseQueryOptions(frame, arguments[1])
+		if err != nil {
+			funl.RunTimeError2(frame, "%s: %v", name, err)
+		}
+
+		var results []funl.Value
+		func() {
+			if isTxn {
+				txn.RLock()
+				defer txn.RUnlock()
+				results, err = q.run(frame, txn.contents(), txn.contentIndexes())
+				return
+			}
+			col.RLock()
+			defer col.RUnlock()
+			results, err = q.run(frame, col.visibleItems(), col.indexes)
+		}()
+		if err != nil {
+			funl.RunTimeError2(frame, "%s: %v", name, err)
+		}
+		retVal = funl.MakeListOfValues(frame, results)
+		return
+	}
+}
+
+func GetVZCount(name string) FZProc {
+	checkValidity := func(arguments []funl.Value) (bool, string) {
+		if l := len(arguments); l != 1 && l != 2 {
+			return false, fmt.Sprintf("%s: wrong amount of arguments (%d)", name, l)
+		}
+		if arguments[0].Kind != funl.OpaqueValue {
+			return false, fmt.Sprintf("%s: requires opaque value", name)
+		}
+		return true, ""
+	}
+
+	return func(frame *funl.Frame, arguments []funl.Value) (retVal funl.Value) {
+		ok, errStr := checkValidity(arguments)
+		if !ok {
+			funl.RunTimeError2(frame, errStr)
+		}
+		isTxn, col, txn := getColAndTxn(arguments[0])
+		if (col == nil) && (txn == nil) {
+			funl.RunTimeError2(frame, "%s: invalid col", name)
+		}
+		var selector *valueSelector
+		if len(arguments) > 1 {
+			var err error
+			if selector, err = newValueSelector(frame, arguments[1]); err != nil {
+				funl.RunTimeError2(frame, "%s: %v", name, err)
+			}
+		}
+
+		var selected map[string]funl.Value
+		var err error
+		func() {
+			if isTxn {
+				txn.RLock()
+				defer txn.RUnlock()
+				selected, err = selector.selectItems(frame, txn.contents(), txn.contentIndexes())
+				return
+			}
+			col.RLock()
+			defer col.RUnlock()
+			selected, err = selector.selectItems(frame, col.visibleItems(), col.indexes)
+		}()
+		if err != nil {
+			funl.RunTimeError2(frame, "%s: %v", name, err)
+		}
+		retVal = funl.Value{Kind: funl.IntValue, Data: len(selected)}
+		return
+	}
+}
+
+func GetVZAggregate(name string) FZProc {
+	checkValidity := func(arguments []funl.Value) (bool, string) {
+		if l := len(arguments); l != 2 {
+			return false, fmt.Sprintf("%s: wrong amount of arguments (%d), need two", name, l)
+		}
+		if arguments[0].Kind != funl.OpaqueValue {
+			return false, fmt.Sprintf("%s: requires opaque value", name)
+		}
+		if arguments[1].Kind != funl.MapValue {
+			return false, fmt.Sprintf("%s: requires map value", name)
+		}
+		return true, ""
+	}
+
+	return func(frame *funl.Frame, arguments []funl.Value) (retVal funl.Value) {
+		ok, errStr := checkValidity(arguments)
+		if !ok {
+			funl.RunTimeError2(frame, errStr)
+		}
+		isTxn, col, txn := getColAndTxn(arguments[0])
+		if (col == nil) && (txn == nil) {
+			funl.RunTimeError2(frame, "%s: invalid col", name)
+		}
+		opts, err := parseAggregateOptions(frame, arguments[1])
+		if err != nil {
+			funl.RunTimeError2(frame, "%s: %v", name, err)
+		}
+
+		func() {
+			if isTxn {
+				txn.RLock()
+				defer txn.RUnlock()
+				retVal, err = opts.run(frame, txn.contents(), txn.contentIndexes())
+				return
+			}
+			col.RLock()
+			defer col.RUnlock()
+			retVal, err = opts.run(frame, col.visibleItems(), col.indexes)
+		}()
+		if err != nil {
+			funl.RunTimeError2(frame, "%s: %v", name, err)
+		}
+		return
+	}
+}
+
+func GetVZOpenCursor(name string) FZProc {
+	checkValidity := func(arguments []funl.Value) (bool, string) {
+		if l := len(arguments); l != 1 && l != 2 {
+			return false, fmt.Sprintf("%s: wrong amount of arguments (%d)", name, l)
+		}
+		if arguments[0].Kind != funl.OpaqueValue {
+			return false, fmt.Sprintf("%s: requires opaque value", name)
+		}
+		if len(arguments) > 1 && arguments[1].Kind != funl.MapValue {
+			return false, fmt.Sprintf("%s: requires map value", name)
+		}
+		return true, ""
+	}
+
+	return func(frame *funl.Frame, arguments []funl.Value) (retVal funl.Value) {
+		ok, errStr := checkValidity(arguments)
+		if !ok {
+			funl.RunTimeError2(frame, errStr)
+		}
+		isTxn, col, txn := getColAndTxn(arguments[0])
+		if (col == nil) && (txn == nil) {
+			funl.RunTimeError2(frame, "%s: invalid col", name)
+		}
+		optsVal := funl.HandleMapOP(frame, []*funl.Item{})
+		if len(arguments) > 1 {
+			optsVal = arguments[1]
+		}
+		q, err := parseQueryOptions(frame, optsVal)
+		if err != nil {
+			funl.RunTimeError2(frame, "%s: %v", name, err)
+		}
+
+		view := txn
+		if !isTxn {
+			replyCh := make(chan funl.Value)
+			request := &req{
+				reqType: viewReq,
+				replyCh: replyCh,
+				frame:   frame,
+			}
+			col.ch <- *request
+			txnVal := <-replyCh
+			if txnVal.Kind != funl.OpaqueValue {
+				funl.RunTimeError2(frame, "%s: col closed", name)
+			}
+			view = txnVal.Data.(*OpaqueTxn)
+		}
+		cursor, err := newCursor(frame, view, q)
+		if err != nil {
+			funl.RunTimeError2(frame, "%s: %v", name, err)
+		}
+		retVal = funl.Value{Kind: funl.OpaqueValue, Data: cursor}
+		return
+	}
+}
+
+func GetVZNextBatch(name string) FZProc {
+	checkValidity := func(arguments []funl.Value) (bool, string) {
+		if l := len(arguments); l != 2 {
+			return false, fmt.Sprintf("%s: wrong amount of arguments (%d), need two", name, l)
+		}
+		if arguments[0].Kind != funl.OpaqueValue {
+			return false, fmt.Sprintf("%s: requires opaque value", name)
+		}
+		if arguments[1].Kind != funl.IntValue || arguments[1].Data.(int) < 1 {
+			return false, fmt.Sprintf("%s: requires positive int value", name)
+		}
+		return true, ""
+	}
+
+	return func(frame *funl.Frame, arguments []funl.Value) (retVal funl.Value) {
+		ok, errStr := checkValidity(arguments)
+		if !ok {
+			funl.RunTimeError2(frame, errStr)
+		}
+		cursor, isCursor := arguments[0].Data.(*OpaqueCursor)
+		if !isCursor {
+			funl.RunTimeError2(frame, "%s: invalid cursor", name)
+		}
+		batch, err := cursor.nextBatch(frame, arguments[1].Data.(int))
+		if err != nil {
+			funl.RunTimeError2(frame, "%s: %v", name, err)
+		}
+		retVal = funl.MakeListOfValues(frame, batch)
+		return
+	}
+}
+
+func GetVZCloseCursor(name string) FZProc {
+	checkValidity := func(arguments []funl.Value) (bool, string) {
+		if l := len(arguments); l != 1 {
+			return false, fmt.Sprintf("%s: wrong amount of arguments (%d), need one", name, l)
+		}
+		if arguments[0].Kind != funl.OpaqueValue {
+			return false, fmt.Sprintf("%s: requires opaque value", name)
+		}
+		return true, ""
+	}
+
+	return func(frame *funl.Frame, arguments []funl.Value) (retVal funl.Value) {
+		ok, errStr := checkValidity(arguments)
+		if !ok {
+			funl.RunTimeError2(frame, errStr)
+		}
+		cursor, isCursor := arguments[0].Data.(*OpaqueCursor)
+		if !isCursor {
+			funl.RunTimeError2(frame, "%s: invalid cursor", name)
+		}
+		retVal = funl.Value{Kind: funl.BoolValue, Data: cursor.close()}
+		return
+	}
+}
+
+func getColAndTxn(val funl.Value) (isTxn bool, col *OpaqueCol, txn *OpaqueTxn) {
+	var convOK bool
+	txn, convOK = val.Data.(*OpaqueTxn)
+	if convOK {
+		return true, nil, txn
+	}
+	col, convOK = val.Data.(*OpaqueCol)
+	if convOK {
+		return false, col, nil
+	}
+	return false, nil, nil
+}
+
+func GetVZPutValue(name string) FZProc {
+	checkValidity := func(arguments []funl.Value) (bool, string) {
+		if l := len(arguments); l != 2 && l != 3 {
+			return false, fmt.Sprintf("%s: wrong amount of arguments (%d)", name, l)
+		}
+		if arguments[0].Kind != funl.OpaqueValue {
+			return false, fmt.Sprintf("%s: requires opaque value", name)
+		}
+		return true, ""
+	}
+
+	return func(frame *funl.Frame, arguments []funl.Value) (retVal funl.Value) {
+		ok, errStr := checkValidity(arguments)
+		if !ok {
+			funl.RunTimeError2(frame, errStr)
+		}
+		var ttl int
+		if len(arguments) == 3 {
+			var err error
+			if ttl, err = parsePutOptions(frame, arguments[2]); err != nil {
+				funl.RunTimeError2(frame, "%s: %v", name, err)
+			}
+		}
+		isTxn, col, txn := getColAndTxn(arguments[0])
+		if (col == nil) && (txn == nil) {
+			funl.RunTimeError2(frame, "invalid col")
+		}
+		if isTxn {
+			if txn.isReadTxn {
+				funl.RunTimeError2(frame, "%s: not allowed in read txn", name)
+			}
+			txn.Lock()
+			if txn.col.isKeyed() {
+				if _, hasKey := txn.col.keyOf(frame, arguments[1]); !hasKey {
+					txn.Unlock()
+					replyValues := []funl.Value{
+						{
+							Kind: funl.BoolValue,
+							Data: false,
+						},
+						{
+							Kind: funl.StringValue,
+							Data: fmt.Sprintf("value without key: %v", arguments[1]),
+						},
+						{
+							Kind: funl.StringValue,
+							Data: "",
+						},
+					}
+					retVal = funl.MakeListOfValues(frame, replyValues)
+					return
+				}
+			}
+			idVal := txn.putValue(frame, arguments[1], ttl)
+			txn.InvalidateList()
+			txn.Unlock()
+			replyValues := []funl.Value{
+				{
+					Kind: funl.BoolValue,
+					Data: true,
+				},
+				{
+					Kind: funl.StringValue,
+					Data: "",
+				},
+				{
+					Kind: funl.StringValue,
+					Data: idVal,
+				},
+			}
+			retVal = funl.MakeListOfValues(frame, replyValues)
+			return
+		}
+		replyCh := make(chan funl.Value)
+		request := &req{
+			reqType: putReq,
+			reqData: arguments[1],
+			replyCh: replyCh,
+			frame:   frame,
+			ttl:     ttl,
+		}
+		col.ch <- *request
+		retVal = <-replyCh
+		return
+	}
+}
+
+func GetVZPutValues(name string) FZProc {
+	checkValidity := func(arguments []funl.Value) (bool, string) {
+		if l := len(arguments); l != 2 && l != 3 {
+			return false, fmt.Sprintf("%s: wrong amount of arguments (%d)", name, l)
+		}
+		if arguments[0].Kind != funl.OpaqueValue {
+			return false, fmt.Sprintf("%s: requires opaque value", name)
+		}
+		if arguments[1].Kind != funl.ListValue {
+			return false, fmt.Sprintf("%s: requires list value", name)
+		}
+		return true, ""
+	}
+
+	return func(frame *funl.Frame, arguments []funl.Value) (retVal funl.Value) {
+		ok, errStr := checkValidity(arguments)
+		if !ok {
+			funl.RunTimeError2(frame, errStr)
+		}
+		var ttl int
+		if len(arguments) == 3 {
+			var err error
+			if ttl, err = parsePutOptions(frame, arguments[2]); err != nil {
+				funl.RunTimeError2(frame, "%s: %v", name, err)
+			}
+		}
+		isTxn, col, txn := getColAndTxn(arguments[0])
+		if (col == nil) && (txn == nil) {
+			funl.RunTimeError2(frame, "invalid col")
+		}
+		if isTxn {
+			if txn.isReadTxn {
+				funl.RunTimeError2(frame, "%s: not allowed in read txn", name)
+			}
+			values := listValues(arguments[1])
+			errText := ""
+			ids := []funl.Value{}
+			txn.Lock()
+			if txn.col.isKeyed() {
+				for _, val := range values {
+					if _, hasKey := txn.col.keyOf(frame, val); !hasKey {
+						errText = fmt.Sprintf("value without key: %v", val)
+						break
+					}
+				}
+			}
+			if errText == "" {
+				for _, val := range values {
+					idVal := txn.putValue(frame, val, ttl)
+					ids = append(ids, funl.Value{Kind: funl.StringValue, Data: idVal})
+				}
+				txn.InvalidateList()
+			}
+			txn.Unlock()
+			replyValues := []funl.Value{
+				{
+					Kind: funl.BoolValue,
+					Data: errText == "",
+				},
+				{
+					Kind: funl.StringValue,
+					Data: errText,
+				},
+				funl.MakeListOfValues(frame, ids),
+			}
+			retVal = funl.MakeListOfValues(frame, replyValues)
+			return
+		}
+		replyCh := make(chan funl.Value)
+		request := &req{
+			reqType: putValuesReq,
+			reqData: arguments[1],
+			replyCh: replyCh,
+			frame:   frame,
+			ttl:     ttl,
+		}
+		col.ch <- *request
+		retVal = <-replyCh
+		return
+	}
+}
+
+func GetVZGetByID(name string) FZProc {
+	checkValidity := func(arguments []funl.Value) (bool, string) {
+		if l := len(arguments); l != 2 {
+			return false, fmt.Sprintf("%s: wrong amount of arguments (%d), need two", name, l)
+		}
+		if arguments[0].Kind != funl.OpaqueValue {
+			return false, fmt.Sprintf("%s: requires opaque value", name)
+		}
+		if arguments[1].Kind != funl.StringValue {
+			return false, fmt.Sprintf("%s: requires string value", name)
+		}
+		return true, ""
+	}
+
+	return func(frame *funl.Frame, arguments []funl.Value) (retVal funl.Value) {
+		ok, errStr := checkValidity(arguments)
+		if !ok {
+			funl.RunTimeError2(frame, errStr)
+		}
+		isTxn, col, txn := getColAndTxn(arguments[0])
+		if (col == nil) && (txn == nil) {
+			funl.RunTimeError2(frame, "%s: invalid col", name)
+		}
+		itemID := arguments[1].Data.(string)
+		var val funl.Value
+		var found bool
+		if isTxn {
+			txn.RLock()
+			val, found = txn.getItem(itemID)
+			txn.RUnlock()
+		} else {
+			col.RLock()
+			val, found = col.visibleItem(itemID)
+			col.RUnlock()
+		}
+		if !found {
+			val = funl.Value{Kind: funl.StringValue, Data: ""}
+		}
+		retVal = funl.MakeListOfValues(frame, []funl.Value{{Kind: funl.BoolValue, Data: found}, val})
+		return
+	}
+}
+
+func GetVZTakeByID(name string) FZProc {
+	checkValidity := func(arguments []funl.Value) (bool, string) {
+		if l := len(arguments); l != 2 {
+			return false, fmt.Sprintf("%s: wrong amount of arguments (%d), need two", name, l)
+		}
+		if arguments[0].Kind != funl.OpaqueValue {
+			return false, fmt.Sprintf("%s: requires opaque value", name)
+		}
+		if arguments[1].Kind != funl.StringValue {
+			return false, fmt.Sprintf("%s: requires string value", name)
+		}
+		return true, ""
+	}
+
+	return func(frame *funl.Frame, arguments []funl.Value) (retVal funl.Value) {
+		ok, errStr := checkValidity(arguments)
+		if !ok {
+			funl.RunTimeError2(frame, errStr)
+		}
+		isTxn, col, txn := getColAndTxn(arguments[0])
+		if (col == nil) && (txn == nil) {
+			funl.RunTimeError2(frame, "%s: invalid col", name)
+		}
+		itemID := arguments[1].Data.(string)
+		if isTxn {
+			if txn.isReadTxn {
+				funl.RunTimeError2(frame, "%s: not allowed in read txn", name)
+			}
+			txn.Lock()
+			val, found := txn.getItem(itemID)
+			if found {
+				txn.newDeleted[itemID] = true
+				txn.InvalidateList()
+			} else {
+				val = funl.Value{Kind: funl.StringValue, Data: ""}
+			}
+			txn.Unlock()
+			retVal = funl.MakeListOfValues(frame, []funl.Value{{Kind: funl.BoolValue, Data: found}, val})
+			return
+		}
+
+		replyCh := make(chan funl.Value)
+		request := &req{
+			reqType: takeByIDReq,
+			replyCh: replyCh,
+			frame:   frame,
+			itemID:  itemID,
+		}
+		col.ch <- *request
+		retVal = <-replyCh
+		return
+	}
+}
+
+func GetVZReplaceByID(name string) FZProc {
+	checkValidity := func(arguments []funl.Value) (bool, string) {
+		if l := len(arguments); l != 3 {
+			return false, fmt.Sprintf("%s: wrong amount of arguments (%d), need three", name, l)
+		}
+		if arguments[0].Kind != funl.OpaqueValue {
+			return false, fmt.Sprintf("%s: requires opaque value", name)
+		}
+		if arguments[1].Kind != funl.StringValue {
+			return false, fmt.Sprintf("%s: requires string value", name)
+		}
+		return true, ""
+	}
+
+	return func(frame *funl.Frame, arguments []funl.Value) (retVal funl.Value) {
+		ok, errStr := checkValidity(arguments)
+		if !ok {
+			funl.RunTimeError2(frame, errStr)
+		}
+		isTxn, col, txn := getColAndTxn(arguments[0])
+		if (col == nil) && (txn == nil) {
+			funl.RunTimeError2(frame, "%s: invalid col", name)
+		}
+		itemID := arguments[1].Data.(string)
+		if isTxn {
+			if txn.isReadTxn {
+				funl.RunTimeError2(frame, "%s: not allowed in read txn", name)
+			}
+			var errText string
+			txn.Lock()
+			if _, found := txn.getItem(itemID); found {
+				txn.newM[itemID] = arguments[2]
+				txn.newUPD[itemID] = arguments[2]
+				txn.noteKey(frame, itemID, arguments[2])
+				txn.InvalidateList()
+			} else {
+				errText = fmt.Sprintf("item not found (%s)", itemID)
+			}
+			txn.Unlock()
+			replyValues := []funl.Value{
+				{
+					Kind: funl.BoolValue,
+					Data: errText == "",
+				},
+				{
+					Kind: funl.StringValue,
+					Data: errText,
+				},
+			}
+			retVal = funl.MakeListOfValues(frame, replyValues)
+			return
+		}
+
+		replyCh := make(chan funl.Value)
+		request := &req{
+			reqType: replaceByIDReq,
+			reqData: arguments[2],
+			replyCh: replyCh,
+			frame:   frame,
+			itemID:  itemID,
+		}
+		col.ch <- *request
+		retVal = <-replyCh
+		return
+	}
+}
+
+func GetVZGetByKey(name string) FZProc {
+	checkValidity := func(arguments []funl.Value) (bool, string) {
+		if l := len(arguments); l != 2 {
+			return false, fmt.Sprintf("%s: wrong amount of arguments (%d), need two", name, l)
+		}
+		if arguments[0].Kind != funl.OpaqueValue {
+			return false, fmt.Sprintf("%s: requires opaque value", name)
+		}
+		return true, ""
+	}
+
+	return func(frame *funl.Frame, arguments []funl.Value) (retVal funl.Value) {
+		ok, errStr := checkValidity(arguments)
+		if !ok {
+			funl.RunTimeError2(frame, errStr)
+		}
+		isTxn, col, txn := getColAndTxn(arguments[0])
+		if (col == nil) && (txn == nil) {
+			funl.RunTimeError2(frame, "%s: invalid col", name)
+		}
+		if isTxn {
+			col = txn.col
+		}
+		if !col.isKeyed() {
+			funl.RunTimeError2(frame, "%s: col has no key", name)
+		}
+		var val funl.Value
+		var found bool
+		if key, keyOK := valueKey(frame, arguments[1]); keyOK {
+			var itemID string
+			if isTxn {
+				txn.RLock()
+				if itemID, found = txn.findByKey(frame, key); found {
+					val, found = txn.getItem(itemID)
+				}
+				txn.RUnlock()
+			} else {
+				col.RLock()
+				if itemID, found = col.keys[key]; found {
+					val, found = col.visibleItem(itemID)
+				}
+				col.RUnlock()
+			}
+		}
+		if !found {
+			val = funl.Value{Kind: funl.StringValue, Data: ""}
+		}
+		retVal = funl.MakeListOfValues(frame, []funl.Value{{Kind: funl.BoolValue, Data: found}, val})
+		return
+	}
+}
+
+func GetVZTakeByKey(name string) FZProc {
+	checkValidity := func(arguments []funl.Value) (bool, string) {
+		if l := len(arguments); l != 2 {
+			return false, fmt.Sprintf("%s: wrong amount of arguments (%d), need two", name, l)
+		}
+		if arguments[0].Kind != funl.OpaqueValue {
+			return false, fmt.Sprintf("%s: requires opaque value", name)
+		}
+		return true, ""
+	}
+
+	return func(frame *funl.Frame, arguments []funl.Value) (retVal funl.Value) {
+		ok, errStr := checkValidity(arguments)
+		if !ok {
+			funl.RunTimeError2(frame, errStr)
+		}
+		isTxn, col, txn := getColAndTxn(arguments[0])
+		if (col == nil) && (txn == nil) {
+			funl.RunTimeError2(frame, "%s: invalid col", name)
+		}
+		if isTxn {
+			if txn.isReadTxn {
+				funl.RunTimeError2(frame, "%s: not allowed in read txn", name)
+			}
+			if !txn.col.isKeyed() {
+				funl.RunTimeError2(frame, "%s: col has no key", name)
+			}
+			var val funl.Value
+			var found bool
+			txn.Lock()
+			if key, keyOK := valueKey(frame, arguments[1]); keyOK {
+				var itemID string
+				if itemID, found = txn.findByKey(frame, key); found {
+					val, _ = txn.getItem(itemID)
+					txn.newDeleted[itemID] = true
+					txn.InvalidateList()
+				}
+			}
+			txn.Unlock()
+			if !found {
+				val = funl.Value{Kind: funl.StringValue, Data: ""}
+			}
+			retVal = funl.MakeListOfValues(frame, []funl.Value{{Kind: funl.BoolValue, Data: found}, val})
+			return
+		}
+		if !col.isKeyed() {
+			funl.RunTimeError2(frame, "%s: col has no key", name)
+		}
+
+		replyCh := make(chan funl.Value)
+		request := &req{
+			reqType: takeByKeyReq,
+			reqData: arguments[1],
+			replyCh: replyCh,
+			frame:   frame,
+		}
+		col.ch <- *request
+		retVal = <-replyCh
+		return
+	}
+}
+
+func GetVZAddListener(name string) FZProc {
+	return func(frame *funl.Frame, arguments []funl.Value) (retVal funl.Value) {
+		if l := len(arguments); l != 2 && l != 3 {
+			funl.RunTimeError2(frame, fmt.Sprintf("%s: wrong amount of arguments (%d)", name, l))
+		}
+		isTxn, col, txn := getColAndTxn(arguments[0])
+		if (col == nil) && (txn == nil) {
+			funl.RunTimeError2(frame, "invalid col")
+		}
+		if isTxn {
+			funl.RunTimeError2(frame, "not supported inside transaction")
+		}
+		if arguments[1].Kind != funl.FunctionValue {
+			funl.RunTimeError2(frame, "2nd argument should be func/proc")
+		}
+		var l *listener
+		if len(arguments) > 2 {
+			var err error
+			if l, err = parseListenerOptions(frame, arguments[2]); err != nil {
+				funl.RunTimeError2(frame, "%s: %v", name, err)
+			}
+		}
+
+		replyCh := make(chan funl.Value)
+		request := &req{
+			reqType:  addListenerReq,
+			reqData:  arguments[1],
+			replyCh:  replyCh,
+			frame:    frame,
+			listener: l,
+		}
+		col.ch <- *request
+		retVal = <-replyCh
+		return
+	}
+}
+
+func GetVZRemoveListener(name string) FZProc {
+	checkValidity := func(arguments []funl.Value) (bool, string) {
+		if l := len(arguments); l != 2 {
+			return false, fmt.Sprintf("%s: wrong amount of arguments (%d), need two", name, l)
+		}
+		if arguments[0].Kind != funl.OpaqueValue {
+			return false, fmt.Sprintf("%s: requires opaque value", name)
+		}
+		if arguments[1].Kind != funl.OpaqueValue {
+			return false, fmt.Sprintf("%s: requires opaque value", name)
+		}
+		return true, ""
+	}
+
+	return func(frame *funl.Frame, arguments []funl.Value) (retVal funl.Value) {
+		ok, errStr := checkValidity(arguments)
+		if !ok {
+			funl.RunTimeError2(frame, errStr)
+		}
+		isTxn, col, txn := getColAndTxn(arguments[0])
+		if (col == nil) && (txn == nil) {
+			funl.RunTimeError2(frame, "%s: invalid col", name)
+		}
+		if isTxn {
+			funl.RunTimeError2(frame, "%s: not supported inside transaction", name)
+		}
+		handle, isHandle := arguments[1].Data.(*OpaqueListener)
+		if !isHandle {
+			funl.RunTimeError2(frame, "%s: assuming listener handle", name)
+		}
+		if handle.col != col {
+			retVal = funl.Value{Kind: funl.BoolValue, Data: false}
+			return
+		}
+
+		replyCh := make(chan funl.Value)
+		request := &req{
+			reqType: removeListenerReq,
+			reqData: arguments[1],
+			replyCh: replyCh,
+			frame:   frame,
+		}
+		col.ch <- *request
+		retVal = <-replyCh
+		if retVal.Kind != funl.BoolValue {
+			// col is closed
+			retVal = funl.Value{Kind: funl.BoolValue, Data: false}
+		}
+		return
+	}
+}
+
+func GetVZListListeners(name string) FZProc {
+	checkValidity := func(arguments []funl.Value) (bool, string) {
+		if l := len(arguments); l != 1 {
+			return false, fmt.Sprintf("%s: wrong amount of arguments (%d), need one", name, l)
+		}
+		if arguments[0].Kind != funl.OpaqueValue {
+			return false, fmt.Sprintf("%s: requires opaque value", name)
+		}
+		return true, ""
+	}
+
+	return func(frame *funl.Frame, arguments []funl.Value) (retVal funl.Value) {
+		ok, errStr := checkValidity(arguments)
+		if !ok {
+			funl.RunTimeError2(frame, errStr)
+		}
+		isTxn, col, txn := getColAndTxn(arguments[0])
+		if (col == nil) && (txn == nil) {
+			funl.RunTimeError2(frame, "%s: invalid col", name)
+		}
+		if isTxn {
+			funl.RunTimeError2(frame, "%s: not supported inside transaction", name)
+		}
 
-func GetVZPutValue(name string) FZProc {
+		replyCh := make(chan funl.Value)
+		request := &req{
+			reqType: listListenersReq,
+			replyCh: replyCh,
+			frame:   frame,
+		}
+		col.ch <- *request
+		retVal = <-replyCh
+		return
+	}
+}
+
+func GetVZSubscribe(name string) FZProc {
 	checkValidity := func(arguments []funl.Value) (bool, string) {
-		if l := len(arguments); l != 2 {
+		if l := len(arguments); l != 1 && l != 2 {
 			return false, fmt.Sprintf("%s: wrong amount of arguments (%d)", name, l)
 		}
 		if arguments[0].Kind != funl.OpaqueValue {
 			return false, fmt.Sprintf("%s: requires opaque value", name)
 		}
+		if len(arguments) > 1 && arguments[1].Kind != funl.MapValue {
+			return false, fmt.Sprintf("%s: requires map value", name)
+		}
 		return true, ""
 	}
 
@@ -530,67 +1693,200 @@ func GetVZPutValue(name string) FZProc {
 		}
 		isTxn, col, txn := getColAndTxn(arguments[0])
 		if (col == nil) && (txn == nil) {
-			funl.RunTimeError2(frame, "invalid col")
+			funl.RunTimeError2(frame, "%s: invalid col", name)
 		}
 		if isTxn {
-			if txn.isReadTxn {
-				funl.RunTimeError2(frame, "%s: not allowed in read txn", name)
-			}
-			txn.col.idCounter++
-			idVal := strconv.Itoa(txn.col.idCounter)
-			txn.Lock()
-			txn.newM[idVal] = arguments[1]
-			delete(txn.newDeleted, idVal)
-			txn.InvalidateList()
-			txn.Unlock()
-			replyValues := []funl.Value{
-				{
-					Kind: funl.BoolValue,
-					Data: true,
-				},
-				{
-					Kind: funl.StringValue,
-					Data: "",
-				},
-			}
-			retVal = funl.MakeListOfValues(frame, replyValues)
-			return
+			funl.RunTimeError2(frame, "%s: not supported inside transaction", name)
+		}
+		optsVal := funl.HandleMapOP(frame, []*funl.Item{})
+		if len(arguments) > 1 {
+			optsVal = arguments[1]
+		}
+		sub, err := parseSubscribeOptions(frame, optsVal)
+		if err != nil {
+			funl.RunTimeError2(frame, "%s: %v", name, err)
+		}
+		if sub.fromSeq >= 0 && !col.changelog {
+			funl.RunTimeError2(frame, "%s: col has no changelog", name)
 		}
+
 		replyCh := make(chan funl.Value)
 		request := &req{
-			reqType: putReq,
-			reqData: arguments[1],
+			reqType: subscribeReq,
 			replyCh: replyCh,
 			frame:   frame,
+			sub:     sub,
 		}
 		col.ch <- *request
 		retVal = <-replyCh
+		if retVal.Kind != funl.ChanValue {
+			funl.RunTimeError2(frame, "%s: col closed", name)
+		}
 		return
 	}
 }
 
-func GetVZAddListener(name string) FZProc {
+func GetVZChangesSince(name string) FZProc {
+	checkValidity := func(arguments []funl.Value) (bool, string) {
+		if l := len(arguments); l != 2 && l != 3 {
+			return false, fmt.Sprintf("%s: wrong amount of arguments (%d)", name, l)
+		}
+		if arguments[0].Kind != funl.OpaqueValue {
+			return false, fmt.Sprintf("%s: requires opaque value", name)
+		}
+		if arguments[1].Kind != funl.IntValue {
+			return false, fmt.Sprintf("%s: requires int value", name)
+		}
+		if len(arguments) > 2 && arguments[2].Kind != funl.MapValue {
+			return false, fmt.Sprintf("%s: requires map value", name)
+		}
+		return true, ""
+	}
+
 	return func(frame *funl.Frame, arguments []funl.Value) (retVal funl.Value) {
+		ok, errStr := checkValidity(arguments)
+		if !ok {
+			funl.RunTimeError2(frame, errStr)
+		}
+		isTxn, col, txn := getColAndTxn(arguments[0])
+		if (col == nil) && (txn == nil) {
+			funl.RunTimeError2(frame, "%s: invalid col", name)
+		}
+		if isTxn {
+			funl.RunTimeError2(frame, "%s: not supported inside transaction", name)
+		}
+		if !col.changelog {
+			funl.RunTimeError2(frame, "%s: col has no changelog", name)
+		}
+		filter := &eventFilter{}
+		if len(arguments) > 2 {
+			var err error
+			if filter, err = parseChangesOptions(frame, arguments[2]); err != nil {
+				funl.RunTimeError2(frame, "%s: %v", name, err)
+			}
+		}
+
+		logged, err := col.changesSince(frame, arguments[1].Data.(int), 0)
+		if err != nil {
+			funl.RunTimeError2(frame, "%s: %v", name, err)
+		}
+		var events []funl.Value
+		for _, ev := range logged {
+			if filtered, ok := filter.apply(frame, ev); ok {
+				events = append(events, filter.eventValue(frame, filtered))
+			}
+		}
+		retVal = funl.MakeListOfValues(frame, events)
+		return
+	}
+}
+
+func GetVZUnsubscribe(name string) FZProc {
+	checkValidity := func(arguments []funl.Value) (bool, string) {
 		if l := len(arguments); l != 2 {
-			funl.RunTimeError2(frame, fmt.Sprintf("%s: wrong amount of arguments (%d)", name, l))
+			return false, fmt.Sprintf("%s: wrong amount of arguments (%d), need two", name, l)
+		}
+		if arguments[0].Kind != funl.OpaqueValue {
+			return false, fmt.Sprintf("%s: requires opaque value", name)
+		}
+		if arguments[1].Kind != funl.ChanValue {
+			return false, fmt.Sprintf("%s: requires channel value", name)
+		}
+		return true, ""
+	}
+
+	return func(frame *funl.Frame, arguments []funl.Value) (retVal funl.Value) {
+		ok, errStr := checkValidity(arguments)
+		if !ok {
+			funl.RunTimeError2(frame, errStr)
 		}
 		isTxn, col, txn := getColAndTxn(arguments[0])
 		if (col == nil) && (txn == nil) {
-			funl.RunTimeError2(frame, "invalid col")
+			funl.RunTimeError2(frame, "%s: invalid col", name)
 		}
 		if isTxn {
-			funl.RunTimeError2(frame, "not supported inside transaction")
+			funl.RunTimeError2(frame, "%s: not supported inside transaction", name)
 		}
-		if arguments[1].Kind != funl.FunctionValue {
-			funl.RunTimeError2(frame, "2nd argument should be func/proc")
+		// not via col goroutine as it may be blocked in sending to channel
+		removed := col.unsubscribe(arguments[1].Data.(chan funl.Value))
+		retVal = funl.Value{Kind: funl.BoolValue, Data: removed}
+		return
+	}
+}
+
+func GetVZColStats(name string) FZProc {
+	checkValidity := func(arguments []funl.Value) (bool, string) {
+		if l := len(arguments); l != 1 {
+			return false, fmt.Sprintf("%s: wrong amount of arguments (%d), need one", name, l)
+		}
+		if arguments[0].Kind != funl.OpaqueValue {
+			return false, fmt.Sprintf("%s: requires opaque value", name)
+		}
+		return true, ""
+	}
+
+	return func(frame *funl.Frame, arguments []funl.Value) (retVal funl.Value) {
+		ok, errStr := checkValidity(arguments)
+		if !ok {
+			funl.RunTimeError2(frame, errStr)
+		}
+		isTxn, col, txn := getColAndTxn(arguments[0])
+		if (col == nil) && (txn == nil) {
+			funl.RunTimeError2(frame, "%s: invalid col", name)
+		}
+		if isTxn {
+			funl.RunTimeError2(frame, "%s: not supported inside transaction", name)
+		}
+
+		replyCh := make(chan funl.Value)
+		request := &req{
+			reqType: colStatsReq,
+			replyCh: replyCh,
+			frame:   frame,
+		}
+		col.ch <- *request
+		retVal = <-replyCh
+		if retVal.Kind != funl.MapValue {
+			funl.RunTimeError2(frame, "%s: col closed", name)
+		}
+		return
+	}
+}
+
+func GetVZAddIndex(name string) FZProc {
+	checkValidity := func(arguments []funl.Value) (bool, string) {
+		if l := len(arguments); l != 3 {
+			return false, fmt.Sprintf("%s: wrong amount of arguments (%d), need three", name, l)
+		}
+		if arguments[0].Kind != funl.OpaqueValue {
+			return false, fmt.Sprintf("%s: requires opaque value", name)
+		}
+		if arguments[1].Kind != funl.StringValue {
+			return false, fmt.Sprintf("%s: requires string value", name)
+		}
+		return true, ""
+	}
+
+	return func(frame *funl.Frame, arguments []funl.Value) (retVal funl.Value) {
+		ok, errStr := checkValidity(arguments)
+		if !ok {
+			funl.RunTimeError2(frame, errStr)
+		}
+		isTxn, col, txn := getColAndTxn(arguments[0])
+		if (col == nil) && (txn == nil) {
+			funl.RunTimeError2(frame, "%s: invalid col", name)
+		}
+		if isTxn {
+			funl.RunTimeError2(frame, "%s: not supported inside transaction", name)
 		}
 
 		replyCh := make(chan funl.Value)
 		request := &req{
-			reqType: addListenerReq,
+			reqType: addIndexReq,
 			reqData: arguments[1],
 			replyCh: replyCh,
 			frame:   frame,
+			keyPath: keyPathFromValue(arguments[2]),
 		}
 		col.ch <- *request
 		retVal = <-replyCh
@@ -598,6 +1894,43 @@ func GetVZAddListener(name string) FZProc {
 	}
 }
 
+func GetVZGetByIndex(name string) FZProc {
+	checkValidity := func(arguments []funl.Value) (bool, string) {
+		if l := len(arguments); l != 3 {
+			return false, fmt.Sprintf("%s: wrong amount of arguments (%d), need three", name, l)
+		}
+		if arguments[0].Kind != funl.OpaqueValue {
+			return false, fmt.Sprintf("%s: requires opaque value", name)
+		}
+		if arguments[1].Kind != funl.StringValue {
+			return false, fmt.Sprintf("%s: requires string value", name)
+		}
+		return true, ""
+	}
+
+	return func(frame *funl.Frame, arguments []funl.Value) (retVal funl.Value) {
+		ok, errStr := checkValidity(arguments)
+		if !ok {
+			funl.RunTimeError2(frame, errStr)
+		}
+		_, col, txn := getColAndTxn(arguments[0])
+		if (col == nil) && (txn == nil) {
+			funl.RunTimeError2(frame, "%s: invalid col", name)
+		}
+		idxName := arguments[1].Data.(string)
+		matching, found := lookupIndex(frame, col, txn, idxName, arguments[2])
+		if !found {
+			funl.RunTimeError2(frame, "%s: index not found (%s)", name, idxName)
+		}
+		var results []funl.Value
+		for _, v := range matching {
+			results = append(results, v)
+		}
+		retVal = funl.MakeListOfValues(frame, results)
+		return
+	}
+}
+
 func GetVZItems(name string) FZProc {
 	checkValidity := func(arguments []funl.Value) (bool, string) {
 		if l := len(arguments); l != 1 {
@@ -644,9 +1977,86 @@ func GetVZItems(name string) FZProc {
 	}
 }
 
+func GetVZItemsOrdered(name string) FZProc {
+	checkValidity := func(arguments []funl.Value) (bool, string) {
+		if l := len(arguments); l != 1 {
+			return false, fmt.Sprintf("%s: wrong amount of arguments (%d), need one", name, l)
+		}
+		if arguments[0].Kind != funl.OpaqueValue {
+			return false, fmt.Sprintf("%s: requires opaque value", name)
+		}
+		return true, ""
+	}
+
+	return func(frame *funl.Frame, arguments []funl.Value) (retVal funl.Value) {
+		ok, errStr := checkValidity(arguments)
+		if !ok {
+			funl.RunTimeError2(frame, errStr)
+		}
+		isTxn, col, txn := getColAndTxn(arguments[0])
+		if (col == nil) && (txn == nil) {
+			funl.RunTimeError2(frame, "%s: invalid col", name)
+		}
+
+		var values []funl.Value
+		if isTxn {
+			txn.RLock()
+			values = orderedValues(txn.orderedIDs(), txn.contents())
+			txn.RUnlock()
+		} else {
+			col.RLock()
+			values = orderedValues(col.order.ids, col.visibleItems())
+			col.RUnlock()
+		}
+		retVal = funl.MakeListOfValues(frame, values)
+		return
+	}
+}
+
+func GetVZItemsWithIDs(name string) FZProc {
+	checkValidity := func(arguments []funl.Value) (bool, string) {
+		if l := len(arguments); l != 1 {
+			return false, fmt.Sprintf("%s: wrong amount of arguments (%d), need one", name, l)
+		}
+		if arguments[0].Kind != funl.OpaqueValue {
+			return false, fmt.Sprintf("%s: requires opaque value", name)
+		}
+		return true, ""
+	}
+
+	return func(frame *funl.Frame, arguments []funl.Value) (retVal funl.Value) {
+		ok, errStr := checkValidity(arguments)
+		if !ok {
+			funl.RunTimeError2(frame, errStr)
+		}
+		isTxn, col, txn := getColAndTxn(arguments[0])
+		if (col == nil) && (txn == nil) {
+			funl.RunTimeError2(frame, "invalid col")
+		}
+
+		pairs := []funl.Value{}
+		if isTxn {
+			txn.RLock()
+			for k, v := range txn.contents() {
+				pairs = append(pairs, funl.MakeListOfValues(frame, []funl.Value{{Kind: funl.StringValue, Data: k}, v}))
+			}
+			txn.RUnlock()
+		} else {
+			col.RLock()
+			for k, v := range col.visibleItems() {
+				pairs = append(pairs, funl.MakeListOfValues(frame, []funl.Value{{Kind: funl.StringValue, Data: k}, v}))
+			}
+			col.RUnlock()
+		}
+		retVal = funl.MakeListOfValues(frame, pairs)
+		return
+	}
+}
+
 func GetVZNewCol(name string) FZProc {
 	checkValidity := func(arguments []funl.Value) (bool, string) {
-		if l := len(arguments); l != 2 {
+		l := len(arguments)
+		if l != 2 && l != 3 {
 			return false, fmt.Sprintf("%s: wrong amount of arguments (%d), need two", name, l)
 		}
 		if arguments[0].Kind != funl.OpaqueValue {
@@ -655,6 +2065,9 @@ func GetVZNewCol(name string) FZProc {
 		if arguments[1].Kind != funl.StringValue {
 			return false, fmt.Sprintf("%s: requires string value", name)
 		}
+		if l == 3 && arguments[2].Kind != funl.MapValue {
+			return false, fmt.Sprintf("%s: requires map value", name)
+		}
 		return true, ""
 	}
 
@@ -667,6 +2080,20 @@ func GetVZNewCol(name string) FZProc {
 				errStr = "assuming db value"
 			}
 		}
+
+		// parse options map (if given)
+		opts := &colOptions{}
+		if ok && len(arguments) == 3 {
+			var optsErr error
+			opts, optsErr = parseColOptions(frame, arguments[2])
+			if optsErr != nil {
+				ok = false
+				errStr = fmt.Sprintf("%s: %v", name, optsErr)
+			} else if opts.keyFunc != nil && !dbVal.inMemOnly {
+				ok = false
+				errStr = fmt.Sprintf("%s: key-func can be used only in in-mem db", name)
+			}
+		}
 		var values []funl.Value
 		if !ok {
 			values = []funl.Value{
@@ -684,7 +2111,7 @@ func GetVZNewCol(name string) FZProc {
 			return
 		}
 		colName := arguments[1].Data.(string)
-		col := newOpaqueCol(frame, colName, dbVal)
+		col := newOpaqueCol(frame, colName, dbVal, opts)
 
 		replych := make(chan error)
 		adminOp := adminOP{
@@ -951,6 +2378,8 @@ func GetVZClose(name string) FZProc {
 		}
 		dbVal.AdminCh <- adminOp
 		err := <-replych
+		// db listeners get 'closed' event before returning
+		dbVal.dbEvents.waitDone()
 
 		var errText string
 		if err != nil {
@@ -0,0 +1,109 @@
+package fuvaluez
+
+import (
+	"github.com/anssihalmeaho/funl/funl"
+)
+
+func (col *OpaqueCol) isCapped() bool {
+	return col.maxItems > 0 || col.maxBytes > 0
+}
+
+// valueSize returns size of value as encoded to persistent storage
+func (col *OpaqueCol) valueSize(frame *funl.Frame, val funl.Value) int {
+	res := funl.HandleCallOP(frame, []*funl.Item{valItem(col.Db.encoderVal), valItem(val)})
+	return len(res.Data.(string))
+}
+
+// setSize keeps size of item up to date (if col has max-bytes)
+func (col *OpaqueCol) setSize(itemID string, size int) {
+	if col.maxBytes <= 0 {
+		return
+	}
+	col.totalSize += size - col.sizes[itemID]
+	col.sizes[itemID] = size
+}
+
+func (col *OpaqueCol) removeSize(itemID string) {
+	if col.maxBytes <= 0 {
+		return
+	}
+	col.totalSize -= col.sizes[itemID]
+	delete(col.sizes, itemID)
+}
+
+// evictions returns ids of oldest items which need to be evicted so that
+// col is within its caps after change (written values and deleted ids),
+// items written in change are not evicted
+func (col *OpaqueCol) evictions(frame *funl.Frame, written map[string]funl.Value, deleted map[string]bool) []string {
+	if !col.isCapped() {
+		return nil
+	}
+	count, size := len(col.Items), col.totalSize
+	for itemID, val := range written {
+		if _, found := col.Items[itemID]; !found {
+			count++
+		}
+		if col.maxBytes > 0 {
+			size += col.valueSize(frame, val) - col.sizes[itemID]
+		}
+	}
+	for itemID := range deleted {
+		if _, found := col.Items[itemID]; found {
+			count--
+			size -= col.sizes[itemID]
+		}
+	}
+
+	var evicted []string
+	for _, itemID := range col.order.ids {
+		if (col.maxItems <= 0 || count <= col.maxItems) && (col.maxBytes <= 0 || size <= col.maxBytes) {
+			break
+		}
+		if _, found := col.Items[itemID]; !found {
+			continue
+		}
+		if _, found := written[itemID]; found || deleted[itemID] {
+			continue
+		}
+		evicted = append(evicted, itemID)
+		count--
+		size -= col.sizes[itemID]
+	}
+	return evicted
+}
+
+// evictChanges makes changes to persistent storage for evicted items,
+// event of eviction is made too (if there are evicted items)
+func (col *OpaqueCol) evictChanges(evicted []string) ([]changeItem, *colEvent) {
+	var chlist []changeItem
+	var items []eventItem
+	for _, itemID := range evicted {
+		chlist = append(chlist, changeItem{
+			ChType:  delValue,
+			Key:     itemID,
+			Val:     nil,
+			ColName: col.colName,
+		})
+		items = append(items, eventItem{id: itemID, val: col.Items[itemID]})
+	}
+	if len(evicted) == 0 {
+		return chlist, nil
+	}
+	ev := newItemsEvent("deleted", items)
+	ev.reason = reasonEvicted
+	return chlist, ev
+}
+
+// changedItems returns items added or updated in transaction
+// (unchanged items may be in newM too)
+func (txn *OpaqueTxn) changedItems() map[string]funl.Value {
+	changed := make(map[string]funl.Value)
+	for itemID, val := range txn.newM {
+		_, isOld := txn.col.Items[itemID]
+		_, isUpdated := txn.newUPD[itemID]
+		if !isOld || isUpdated {
+			changed[itemID] = val
+		}
+	}
+	return changed
+}
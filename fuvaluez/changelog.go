@@ -0,0 +1,166 @@
+package fuvaluez
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/anssihalmeaho/funl/funl"
+	bolt "go.etcd.io/bbolt"
+)
+
+// seqKey makes storage key for change log sequence number (keeps order)
+func seqKey(seq int) string {
+	return fmt.Sprintf("%020d", seq)
+}
+
+// logChange assigns commit sequence numbers and time for events (in given order) and
+// adds change log entries for them to changelist (if col has change log),
+// oldest entries are removed from change log if it has max size.
+// Latest sequence number is stored in same write so that it continues after db is opened again
+func (col *OpaqueCol) logChange(frame *funl.Frame, chlist []changeItem, events ...*colEvent) []changeItem {
+	seq := col.seq
+	now := int(time.Now().UnixNano() / int64(time.Millisecond))
+	for _, ev := range events {
+		if ev == nil {
+			continue
+		}
+		seq++
+		ev.seq = seq
+		ev.time = now
+		if !col.changelog {
+			continue
+		}
+		ev.logged = true
+		evVal := ev.toRichValue(frame)
+		chlist = append(chlist, changeItem{
+			ChType:  logEvent,
+			Key:     seqKey(ev.seq),
+			Val:     &evVal,
+			ColName: col.colName,
+		})
+	}
+	if seq > col.seq {
+		chlist = append(chlist, changeItem{
+			ChType:  seqValue,
+			Key:     strconv.Itoa(seq),
+			ColName: col.colName,
+		})
+	}
+	if col.changelog && col.logMax > 0 && seq > col.logMax {
+		chlist = append(chlist, changeItem{
+			ChType:  trimLog,
+			Key:     seqKey(seq - col.logMax + 1),
+			ColName: col.colName,
+		})
+	}
+	return chlist
+}
+
+// commitLog takes sequence number of event into use after changes are
+// written to persistent storage (event is appended to change log of in-mem db)
+func (col *OpaqueCol) commitLog(ev *colEvent) {
+	if ev == nil {
+		return
+	}
+	col.logMutex.Lock()
+	defer col.logMutex.Unlock()
+
+	col.seq = ev.seq
+	if !ev.logged || !col.Db.inMemOnly {
+		return
+	}
+	col.changeLog = append(col.changeLog, ev)
+	if col.logMax > 0 && len(col.changeLog) > col.logMax {
+		col.changeLog = append([]*colEvent{}, col.changeLog[len(col.changeLog)-col.logMax:]...)
+	}
+}
+
+// lastSeq returns sequence number of latest committed event
+func (col *OpaqueCol) lastSeq() int {
+	col.logMutex.Lock()
+	defer col.logMutex.Unlock()
+	return col.seq
+}
+
+// changesSince returns logged events which have sequence number bigger than given one
+// (at most limit events if limit > 0), events are read from persistent storage
+// unless db is in-mem db
+func (col *OpaqueCol) changesSince(frame *funl.Frame, seq int, limit int) ([]*colEvent, error) {
+	if col.Db.inMemOnly {
+		col.logMutex.Lock()
+		defer col.logMutex.Unlock()
+
+		// sequence numbers are in ascending order
+		for i, ev := range col.changeLog {
+			if ev.seq > seq {
+				events := col.changeLog[i:]
+				if limit > 0 && len(events) > limit {
+					events = events[:limit]
+				}
+				return append([]*colEvent{}, events...), nil
+			}
+		}
+		return nil, nil
+	}
+
+	var events []*colEvent
+	err := col.Db.store.View(func(tx *bolt.Tx) error {
+		colLog := logBucket(tx, col.colName)
+		if colLog == nil {
+			return nil
+		}
+		c := colLog.Cursor()
+		for k, v := c.Seek([]byte(seqKey(seq + 1))); k != nil; k, v = c.Next() {
+			if limit > 0 && len(events) >= limit {
+				break
+			}
+			evSeq, err := strconv.Atoi(string(k))
+			if err != nil {
+				return err
+			}
+			ev, err := eventFromValue(frame, col.Db.decode(frame, v))
+			if err != nil {
+				return err
+			}
+			ev.seq = evSeq
+			ev.logged = true
+			events = append(events, ev)
+		}
+		return nil
+	})
+	return events, err
+}
+
+// logBucket returns change log bucket of col (nil if there's none)
+func logBucket(tx *bolt.Tx, colName string) *bolt.Bucket {
+	logsBucket := tx.Bucket([]byte("__changelog"))
+	if logsBucket == nil {
+		return nil
+	}
+	return logsBucket.Bucket([]byte(colName))
+}
+
+// putSeqToPersistent writes latest sequence number of col
+func (db *OpaqueDB) putSeqToPersistent(tx *bolt.Tx, colName string, seq string) error {
+	seqBucket, err := tx.CreateBucketIfNotExists([]byte("__seq"))
+	if err != nil {
+		return err
+	}
+	return seqBucket.Put([]byte(colName), []byte(seq))
+}
+
+// trimLogInPersistent removes change log entries older than given sequence number key
+func (db *OpaqueDB) trimLogInPersistent(tx *bolt.Tx, colName string, firstKey string) error {
+	colLog := logBucket(tx, colName)
+	if colLog == nil {
+		return nil
+	}
+	c := colLog.Cursor()
+	for k, _ := c.First(); k != nil && string(k) < firstKey; k, _ = c.First() {
+		if err := c.Delete(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
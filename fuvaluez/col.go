@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"strconv"
 	"sync"
+	"time"
 
 	"github.com/anssihalmeaho/funl/funl"
 )
@@ -11,23 +12,97 @@ import (
 // OpaqueCol represents collection
 type OpaqueCol struct {
 	sync.RWMutex
-	Items          map[string]funl.Value
-	ch             chan req
-	idCounter      int
-	latestSnapshot map[string]funl.Value
-	Db             *OpaqueDB
-	colName        string
-	Closed         bool
-	AsList         *funl.Value
-	listeners      []*funl.Item
-	closedMutex    sync.RWMutex
+	Items           map[string]funl.Value
+	ch              chan req
+	idCounter       int
+	latestSnapshot  map[string]funl.Value
+	Db              *OpaqueDB
+	colName         string
+	Closed          bool
+	AsList          *funl.Value
+	listeners       []*listener
+	closedMutex     sync.RWMutex
+	indexes         map[string]*colIndex
+	latestIndexes   map[string]*colIndex
+	options         funl.Value
+	keyPath         []funl.Value
+	keyFunc         *funl.Item
+	keys            map[string]string
+	latestKeys      map[string]string
+	changelog       bool
+	logMax          int // max number of events kept in change log (0 means no limit)
+	seq             int
+	changeLog       []*colEvent // change log of in-mem db (otherwise it's read from persistent storage)
+	logMutex        sync.Mutex
+	waiters         []*waiter
+	listenerCounter int
+	subscribers     []*subscriber
+	subsMutex       sync.Mutex
+
+	listenerFailures int // listener calls which made RTE
+
+	order       itemOrder // item ids in insertion order
+	latestOrder []string
+
+	maxItems  int            // max number of items (0 means no cap)
+	maxBytes  int            // max total size of encoded values (0 means no cap)
+	sizes     map[string]int // encoded sizes of values (if col has max-bytes)
+	totalSize int
+
+	ttl         int                     // default time-to-live of values in milliseconds (0 means no expiry)
+	expiry      map[string]*expiryEntry // expiry times of items
+	expiryQueue expiryHeap              // expiry times in min-heap (earliest first)
+	sweepAt     int                     // expiry time for which sweep timer is set
+	sweepTimer  *time.Timer
 }
 
-func (col *OpaqueCol) hasListeners() bool {
-	if col.listeners == nil {
-		col.listeners = []*funl.Item{}
+// setItem sets value for item and keeps indexes up to date
+func (col *OpaqueCol) setItem(frame *funl.Frame, itemID string, val funl.Value) {
+	if oldv, found := col.Items[itemID]; found {
+		for _, idx := range col.indexes {
+			idx.remove(frame, itemID, oldv)
+		}
+		col.removeKey(frame, itemID, oldv)
+	} else {
+		col.order.add(itemID)
+	}
+	col.Items[itemID] = val
+	if col.maxBytes > 0 {
+		col.setSize(itemID, col.valueSize(frame, val))
+	}
+	for _, idx := range col.indexes {
+		idx.add(frame, itemID, val)
+	}
+	if col.isKeyed() {
+		if key, ok := col.keyOf(frame, val); ok {
+			col.keys[key] = itemID
+		}
 	}
-	return len(col.listeners) > 0
+}
+
+func (col *OpaqueCol) removeKey(frame *funl.Frame, itemID string, oldv funl.Value) {
+	if !col.isKeyed() {
+		return
+	}
+	if key, ok := col.keyOf(frame, oldv); ok && col.keys[key] == itemID {
+		delete(col.keys, key)
+	}
+}
+
+// removeItem removes item and its index entries
+func (col *OpaqueCol) removeItem(frame *funl.Frame, itemID string) {
+	oldv, found := col.Items[itemID]
+	if !found {
+		return
+	}
+	for _, idx := range col.indexes {
+		idx.remove(frame, itemID, oldv)
+	}
+	col.removeKey(frame, itemID, oldv)
+	delete(col.Items, itemID)
+	col.removeSize(itemID)
+	col.setExpiry(itemID, 0)
+	col.order.remove(col.Items)
 }
 
 // TypeName gives type name
@@ -67,13 +142,22 @@ func (txn *OpaqueTxn) Equals(with funl.OpaqueAPI) bool {
 // OpaqueTxn represents transaction
 type OpaqueTxn struct {
 	sync.RWMutex
-	isReadTxn  bool
-	newM       map[string]funl.Value
-	newDeleted map[string]bool
-	newUPD     map[string]funl.Value
-	snapM      map[string]funl.Value
-	col        *OpaqueCol
-	AsList     *funl.Value
+	isReadTxn   bool
+	newM        map[string]funl.Value
+	newDeleted  map[string]bool
+	newUPD      map[string]funl.Value
+	snapM       map[string]funl.Value
+	snapIndexes map[string]*colIndex
+	snapKeys    map[string]string
+	snapOrder   []string
+	newKeys     map[string]string
+	col         *OpaqueCol
+	AsList      *funl.Value
+	event       *colEvent // made when changes are committed
+	tag         string    // transaction tag given in trans options
+	evicted     []string  // ids of items evicted when committed (capped col)
+	evictEvent  *colEvent
+	newExpiry   map[string]int // expiry times of values put in transaction (0 means no expiry)
 }
 
 func (txn *OpaqueTxn) InvalidateList() {
@@ -87,15 +171,7 @@ func (txn *OpaqueTxn) MakeList(frame *funl.Frame) {
 			newItems[k] = v
 		}
 	} else {
-		for k, v := range txn.col.Items {
-			newItems[k] = v
-		}
-		for k, v := range txn.newM {
-			newItems[k] = v
-		}
-		for itemID := range txn.newDeleted {
-			delete(newItems, itemID)
-		}
+		newItems = txn.contents()
 	}
 	values := []funl.Value{}
 	for _, v := range newItems {
@@ -106,12 +182,84 @@ func (txn *OpaqueTxn) MakeList(frame *funl.Frame) {
 	txn.AsList = &list
 }
 
+// getItem returns value of item as seen in transaction/view
+func (txn *OpaqueTxn) getItem(itemID string) (funl.Value, bool) {
+	if txn.isReadTxn {
+		v, found := txn.snapM[itemID]
+		return v, found
+	}
+	if txn.newDeleted[itemID] {
+		return funl.Value{}, false
+	}
+	if v, found := txn.newM[itemID]; found {
+		return v, true
+	}
+	if txn.col.isExpired(itemID, nowMs()) {
+		return funl.Value{}, false
+	}
+	v, found := txn.col.Items[itemID]
+	return v, found
+}
+
+// putValue writes value in transaction (value needs to have key in keyed col),
+// returns id of item, txn needs to be locked
+func (txn *OpaqueTxn) putValue(frame *funl.Frame, val funl.Value, ttl int) string {
+	var idVal string
+	var isReplace bool
+	if txn.col.isKeyed() {
+		key, _ := txn.col.keyOf(frame, val)
+		idVal, isReplace = txn.findByKey(frame, key)
+	}
+	if isReplace {
+		txn.newUPD[idVal] = val
+	} else {
+		txn.col.idCounter++
+		idVal = strconv.Itoa(txn.col.idCounter)
+	}
+	txn.newM[idVal] = val
+	txn.newExpiry[idVal] = txn.col.expiryFor(ttl)
+	delete(txn.newDeleted, idVal)
+	txn.noteKey(frame, idVal, val)
+	return idVal
+}
+
+// contents returns items (id -> value) as seen in transaction/view
+func (txn *OpaqueTxn) contents() map[string]funl.Value {
+	if txn.isReadTxn {
+		return txn.snapM
+	}
+	m := make(map[string]funl.Value)
+	now := nowMs()
+	for k, v := range txn.col.Items {
+		if !txn.newDeleted[k] && !txn.col.isExpired(k, now) {
+			m[k] = v
+		}
+	}
+	for k, v := range txn.newM {
+		if !txn.newDeleted[k] {
+			m[k] = v
+		}
+	}
+	return m
+}
+
+// contentIndexes returns indexes matching contents of view,
+// nil is returned for write transaction (indexes don't contain its changes)
+func (txn *OpaqueTxn) contentIndexes() map[string]*colIndex {
+	if txn.isReadTxn {
+		return txn.snapIndexes
+	}
+	return nil
+}
+
 func newTxn(col *OpaqueCol, isReadTxn bool) *OpaqueTxn {
 	txn := &OpaqueTxn{
 		isReadTxn:  isReadTxn,
 		newM:       make(map[string]funl.Value),
 		newDeleted: make(map[string]bool),
 		newUPD:     make(map[string]funl.Value),
+		newKeys:    make(map[string]string),
+		newExpiry:  make(map[string]int),
 		col:        col,
 	}
 	return txn
@@ -133,6 +281,290 @@ func getUpdateRetVal(frame *funl.Frame, updRetVal funl.Value) (bool, funl.Value,
 	return doUpdV.Data.(bool), *updVal, ""
 }
 
+// txnChangelist makes changes to persistent storage for transaction,
+// event of transaction is made too
+func (col *OpaqueCol) txnChangelist(frame *funl.Frame, txn *OpaqueTxn) []changeItem {
+	txn.event = col.txnEvent(txn)
+	var chlist []changeItem
+	for k, v := range txn.newM {
+		copyV := v
+		chItem := changeItem{
+			ChType:  newValue,
+			Key:     k,
+			Val:     &copyV,
+			ColName: col.colName,
+		}
+		chlist = append(chlist, chItem)
+	}
+	for itemID := range txn.newDeleted {
+		chItem := changeItem{
+			ChType:  delValue,
+			Key:     itemID,
+			Val:     nil,
+			ColName: col.colName,
+		}
+		chlist = append(chlist, chItem)
+	}
+	for itemID, expiry := range txn.newExpiry {
+		if _, found := txn.newM[itemID]; found && !txn.newDeleted[itemID] {
+			chlist = append(chlist, col.expiryChange(itemID, expiry))
+		}
+	}
+	// oldest items are evicted if col is capped
+	txn.evicted = col.evictions(frame, txn.changedItems(), txn.newDeleted)
+	evictList, evictEv := col.evictChanges(txn.evicted)
+	txn.evictEvent = evictEv
+	return col.logChange(frame, append(chlist, evictList...), txn.event, evictEv)
+}
+
+// txnEvent makes transaction event (compared to current col contents)
+func (col *OpaqueCol) txnEvent(txn *OpaqueTxn) *colEvent {
+	deleted := []eventItem{}
+	added := []eventItem{}
+	updated := []eventItem{}
+
+	for delkey := range txn.newDeleted {
+		delv, exists := col.Items[delkey]
+		if exists {
+			deleted = append(deleted, eventItem{id: delkey, val: delv})
+		}
+	}
+	for newkey, newv := range txn.newM {
+		if _, found := txn.newDeleted[newkey]; found {
+			continue
+		}
+		if _, found := col.Items[newkey]; !found {
+			added = append(added, eventItem{id: newkey, val: newv})
+		}
+	}
+	for newkey, newv := range txn.newUPD {
+		if _, found := txn.newDeleted[newkey]; found {
+			continue
+		}
+		if oldv, found := col.Items[newkey]; found {
+			updated = append(updated, eventItem{id: newkey, val: newv, oldVal: oldv})
+		}
+	}
+	ev := newTransactionEvent(added, updated, deleted)
+	ev.tag = txn.tag
+	return ev
+}
+
+// applyTxn applies transaction (already written to persistent storage)
+// to memory and calls listeners
+func (col *OpaqueCol) applyTxn(frame *funl.Frame, txn *OpaqueTxn) {
+	// to memory
+	col.Lock()
+	// new items are set in order of ids so that insertion order is kept
+	for _, k := range sortedIDs(txn.newM) {
+		col.setItem(frame, k, txn.newM[k])
+	}
+	for itemID, expiry := range txn.newExpiry {
+		if _, found := txn.newM[itemID]; found {
+			col.setExpiry(itemID, expiry)
+		}
+	}
+	for itemID := range txn.newDeleted {
+		col.removeItem(frame, itemID)
+	}
+	for _, itemID := range txn.evicted {
+		col.removeItem(frame, itemID)
+	}
+	col.InvalidateList()
+	col.Unlock()
+	col.latestSnapshot = nil
+
+	col.emit(frame, txn.event)
+	col.emit(frame, txn.evictEvent)
+}
+
+// takeItem removes item from col and storage, returns removed value
+func (col *OpaqueCol) takeItem(frame *funl.Frame, itemID string) (funl.Value, bool) {
+	oldv, found := col.Items[itemID]
+	if !found {
+		return funl.Value{}, false
+	}
+
+	ev := newItemsEvent("deleted", []eventItem{{id: itemID, val: oldv}})
+
+	// to storage
+	replyCh := make(chan error)
+	chItem := changeItem{
+		ChType:  delValue,
+		Key:     itemID,
+		Val:     nil,
+		ColName: col.colName,
+	}
+	col.Db.Ch <- changes{Changelist: col.logChange(frame, []changeItem{chItem}, ev), ReplyCh: replyCh}
+	if <-replyCh != nil {
+		return funl.Value{}, false
+	}
+
+	col.Lock()
+	col.removeItem(frame, itemID)
+	col.InvalidateList()
+	col.Unlock()
+	col.latestSnapshot = nil
+
+	col.emit(frame, ev)
+	return oldv, true
+}
+
+// putValues writes values to col and storage (with one write to storage),
+// returns reply which contains ids of items and whether values were stored
+func (col *OpaqueCol) putValues(frame *funl.Frame, values []funl.Value, ttl int) (funl.Value, bool) {
+	reply := func(ok bool, errText string, ids []funl.Value) (funl.Value, bool) {
+		return funl.MakeListOfValues(frame, []funl.Value{
+			{Kind: funl.BoolValue, Data: ok},
+			{Kind: funl.StringValue, Data: errText},
+			funl.MakeListOfValues(frame, ids),
+		}), ok
+	}
+	if col.isKeyed() {
+		// nothing is written if some value has no key
+		for _, val := range values {
+			if _, hasKey := col.keyOf(frame, val); !hasKey {
+				return reply(false, fmt.Sprintf("value without key: %v", val), []funl.Value{})
+			}
+		}
+	}
+	if len(values) == 0 {
+		return reply(true, "", []funl.Value{})
+	}
+
+	idVals := make([]funl.Value, len(values))
+	written := make(map[string]funl.Value)
+	batchKeys := make(map[string]string) // keys of values in this put
+	for i, val := range values {
+		var idVal, key string
+		var isReplace bool
+		if col.isKeyed() {
+			key, _ = col.keyOf(frame, val)
+			if idVal, isReplace = batchKeys[key]; !isReplace {
+				idVal, isReplace = col.keys[key]
+			}
+		}
+		if !isReplace {
+			col.idCounter++
+			idVal = strconv.Itoa(col.idCounter)
+		}
+		if col.isKeyed() {
+			batchKeys[key] = idVal
+		}
+		idVals[i] = funl.Value{Kind: funl.StringValue, Data: idVal}
+		written[idVal] = val
+	}
+
+	writtenIDs := sortedIDs(written)
+	var addEv, updEv *colEvent
+	var added, updated []eventItem
+	for _, idVal := range writtenIDs {
+		if oldv, found := col.Items[idVal]; found {
+			updated = append(updated, eventItem{id: idVal, val: written[idVal], oldVal: oldv})
+		} else {
+			added = append(added, eventItem{id: idVal, val: written[idVal]})
+		}
+	}
+	if len(added) > 0 {
+		addEv = newItemsEvent("added", added)
+	}
+	if len(updated) > 0 {
+		updEv = newItemsEvent("updated", updated)
+	}
+
+	// oldest items are evicted if col is capped
+	evicted := col.evictions(frame, written, nil)
+	evictList, evictEv := col.evictChanges(evicted)
+	expiry := col.expiryFor(ttl)
+
+	var chlist []changeItem
+	for _, idVal := range writtenIDs {
+		val := written[idVal]
+		chlist = append(chlist, changeItem{
+			ChType:  newValue,
+			Key:     idVal,
+			Val:     &val,
+			ColName: col.colName,
+		})
+		if _, hadExpiry := col.expiry[idVal]; expiry != 0 || hadExpiry {
+			chlist = append(chlist, col.expiryChange(idVal, expiry))
+		}
+	}
+	chlist = append(chlist, evictList...)
+
+	// to storage
+	replyCh := make(chan error)
+	col.Db.Ch <- changes{Changelist: col.logChange(frame, chlist, addEv, updEv, evictEv), ReplyCh: replyCh}
+	if storeErr := <-replyCh; storeErr != nil {
+		return reply(false, fmt.Sprintf("Put to persistent store failed: %v", storeErr), []funl.Value{})
+	}
+
+	// to memory
+	col.Lock()
+	for _, idVal := range writtenIDs {
+		col.setItem(frame, idVal, written[idVal])
+		col.setExpiry(idVal, expiry)
+	}
+	for _, itemID := range evicted {
+		col.removeItem(frame, itemID)
+	}
+	col.InvalidateList()
+	col.Unlock()
+	col.latestSnapshot = nil
+
+	col.emit(frame, addEv)
+	col.emit(frame, updEv)
+	col.emit(frame, evictEv)
+	return reply(true, "", idVals)
+}
+
+// stats returns statistics of col as map
+func (col *OpaqueCol) stats(frame *funl.Frame) funl.Value {
+	col.subsMutex.Lock()
+	subscriberCount := len(col.subscribers)
+	col.subsMutex.Unlock()
+
+	stats := map[string]int{
+		"items":             len(col.Items),
+		"listeners":         len(col.listeners),
+		"subscribers":       subscriberCount,
+		"listener-failures": col.listenerFailures,
+	}
+	var mapItems []*funl.Item
+	for k, v := range stats {
+		mapItems = append(mapItems,
+			&funl.Item{Type: funl.ValueItem, Data: funl.Value{Kind: funl.StringValue, Data: k}},
+			&funl.Item{Type: funl.ValueItem, Data: funl.Value{Kind: funl.IntValue, Data: v}},
+		)
+	}
+	return funl.HandleMapOP(frame, mapItems)
+}
+
+// snapshotTxn makes read txn (view) for latest snapshot of col
+func (col *OpaqueCol) snapshotTxn() *OpaqueTxn {
+	txn := newTxn(col, true)
+	if col.latestSnapshot == nil {
+		col.latestSnapshot = make(map[string]funl.Value)
+		for k, v := range col.Items {
+			col.latestSnapshot[k] = v
+		}
+		col.latestIndexes = make(map[string]*colIndex)
+		for idxName, idx := range col.indexes {
+			col.latestIndexes[idxName] = idx.copy()
+		}
+		col.latestKeys = make(map[string]string)
+		for key, itemID := range col.keys {
+			col.latestKeys[key] = itemID
+		}
+		col.latestOrder = col.order.ids
+	}
+	txn.snapM = col.latestSnapshot
+	txn.snapIndexes = col.latestIndexes
+	txn.snapKeys = col.latestKeys
+	txn.snapOrder = col.latestOrder
+	return txn
+}
+
 // IsClosed tells whether col is closed
 func (col *OpaqueCol) IsClosed() bool {
 	col.closedMutex.RLock()
@@ -177,19 +609,32 @@ func (col *OpaqueCol) MakeList(frame *funl.Frame) {
 // Run runs updator
 func (col *OpaqueCol) Run(frame *funl.Frame) {
 	//col.idCounter = 100
+	// items read from storage may have expiry times
+	col.scheduleSweep(frame)
 	for {
 		req := <-col.ch
+		if req.reqType != shutdownReq && req.reqType != delColReq {
+			// expired items are removed before handling request
+			col.sweepExpired(frame)
+		}
 	reqSwitch:
 		switch req.reqType {
 
+		case sweepReq:
+			// sweep timer is set again
+			col.sweepAt = -1
+
 		case shutdownReq:
 			col.Closed = true
+			col.releaseWaiters()
 			adminOp := adminOP{
 				optype:  "col-suspended",
 				replych: nil,
 				colName: col.colName,
 				col:     col,
 			}
+			col.stopSweep()
+			col.unsubscribeAll()
 			go autoResponser(col.ch)
 			col.Db.AdminCh <- adminOp
 			req.replyCh <- funl.Value{Kind: funl.BoolValue, Data: true}
@@ -212,6 +657,7 @@ func (col *OpaqueCol) Run(frame *funl.Frame) {
 				break reqSwitch
 			}
 			col.Closed = true
+			col.releaseWaiters()
 
 			// removing col from db and storage
 			replych := make(chan error)
@@ -242,6 +688,8 @@ func (col *OpaqueCol) Run(frame *funl.Frame) {
 			replyVal := funl.MakeListOfValues(req.frame, replyValues)
 			req.replyCh <- replyVal
 
+			col.stopSweep()
+			col.unsubscribeAll()
 			go autoResponser(col.ch)
 			return // exit from goroutine
 
@@ -252,16 +700,112 @@ func (col *OpaqueCol) Run(frame *funl.Frame) {
 			req.replyCh <- *col.AsList
 
 		case addListenerReq:
-			if col.listeners == nil {
-				col.listeners = []*funl.Item{}
+			handle := col.addListener(req.reqData, req.listener)
+			req.replyCh <- funl.Value{Kind: funl.OpaqueValue, Data: handle}
+
+		case removeListenerReq:
+			removed := col.removeListener(req.reqData.Data.(*OpaqueListener).id)
+			req.replyCh <- funl.Value{Kind: funl.BoolValue, Data: removed}
+
+		case subscribeReq:
+			col.addSubscriber(req.frame, req.sub)
+			req.replyCh <- funl.Value{Kind: funl.ChanValue, Data: req.sub.ch}
+
+		case colStatsReq:
+			req.replyCh <- col.stats(req.frame)
+
+		case listListenersReq:
+			req.replyCh <- col.listenerHandles(req.frame)
+
+		case addIndexReq:
+			var errText string
+			idxName := req.reqData.Data.(string)
+			if _, found := col.indexes[idxName]; found {
+				errText = fmt.Sprintf("index already exists (%s)", idxName)
+			} else {
+				idx := newColIndex(idxName, req.keyPath)
+
+				// to storage
+				replych := make(chan error)
+				adminOp := adminOP{
+					optype:  "add-index",
+					replych: replych,
+					colName: col.colName,
+					col:     col,
+					index:   idx,
+				}
+				col.Db.AdminCh <- adminOp
+				if storeErr := <-replych; storeErr != nil {
+					errText = fmt.Sprintf("Index write to persistent store failed: %v", storeErr)
+				} else {
+					for k, v := range col.Items {
+						idx.add(req.frame, k, v)
+					}
+					col.Lock()
+					col.indexes[idxName] = idx
+					col.Unlock()
+					col.latestSnapshot = nil
+				}
 			}
-			col.listeners = append(col.listeners, &funl.Item{Type: funl.ValueItem, Data: req.reqData})
-			req.replyCh <- funl.Value{Kind: funl.BoolValue, Data: true}
+			replyValues := []funl.Value{
+				{
+					Kind: funl.BoolValue,
+					Data: errText == "",
+				},
+				{
+					Kind: funl.StringValue,
+					Data: errText,
+				},
+			}
+			req.replyCh <- funl.MakeListOfValues(req.frame, replyValues)
 
 		case putReq:
-			col.idCounter++
-			idVal := strconv.Itoa(col.idCounter)
-			col.Items[idVal] = req.reqData
+			var idVal string
+			var oldv funl.Value
+			var isReplace bool
+			if col.isKeyed() {
+				key, hasKey := col.keyOf(req.frame, req.reqData)
+				if !hasKey {
+					replyValues := []funl.Value{
+						{
+							Kind: funl.BoolValue,
+							Data: false,
+						},
+						{
+							Kind: funl.StringValue,
+							Data: fmt.Sprintf("value without key: %v", req.reqData),
+						},
+						{
+							Kind: funl.StringValue,
+							Data: "",
+						},
+					}
+					req.replyCh <- funl.MakeListOfValues(req.frame, replyValues)
+					break reqSwitch
+				}
+				idVal, isReplace = col.keys[key]
+				if isReplace {
+					oldv = col.Items[idVal]
+				}
+			}
+			if !isReplace {
+				col.idCounter++
+				idVal = strconv.Itoa(col.idCounter)
+			}
+			// oldest items are evicted if col is capped
+			evicted := col.evictions(req.frame, map[string]funl.Value{idVal: req.reqData}, nil)
+			evictList, evictEv := col.evictChanges(evicted)
+
+			// expiry of replaced value is removed if there's no time-to-live for new one
+			expiry := col.expiryFor(req.ttl)
+			_, hadExpiry := col.expiry[idVal]
+
+			var ev *colEvent
+			if isReplace {
+				ev = newItemsEvent("updated", []eventItem{{id: idVal, val: req.reqData, oldVal: oldv}})
+			} else {
+				ev = newItemsEvent("added", []eventItem{{id: idVal, val: req.reqData}})
+			}
 
 			// to storage
 			replyCh := make(chan error)
@@ -271,12 +815,16 @@ func (col *OpaqueCol) Run(frame *funl.Frame) {
 				Val:     &req.reqData,
 				ColName: col.colName,
 			}
-			col.Db.Ch <- changes{Changelist: []changeItem{chItem}, ReplyCh: replyCh}
+			chlist := append([]changeItem{chItem}, evictList...)
+			if expiry != 0 || hadExpiry {
+				chlist = append(chlist, col.expiryChange(idVal, expiry))
+			}
+			col.Db.Ch <- changes{Changelist: col.logChange(req.frame, chlist, ev, evictEv), ReplyCh: replyCh}
 			storeErr := <-replyCh
 
 			var errText string
 			if storeErr != nil {
-				errText = fmt.Sprintf("Put to persistent store failed: %v", errText)
+				errText = fmt.Sprintf("Put to persistent store failed: %v", storeErr)
 			}
 			replyValues := []funl.Value{
 				{
@@ -287,30 +835,145 @@ func (col *OpaqueCol) Run(frame *funl.Frame) {
 					Kind: funl.StringValue,
 					Data: errText,
 				},
+				{
+					Kind: funl.StringValue,
+					Data: idVal,
+				},
+			}
+			if storeErr == nil {
+				// memory is changed only when change is in storage
+				col.Lock()
+				for _, itemID := range evicted {
+					col.removeItem(req.frame, itemID)
+				}
+				col.setItem(req.frame, idVal, req.reqData)
+				col.setExpiry(idVal, expiry)
+				col.Unlock()
 			}
 			replyVal := funl.MakeListOfValues(req.frame, replyValues)
 			col.latestSnapshot = nil
 			col.InvalidateList()
 
-			if col.hasListeners() {
-				if storeErr == nil {
-					for _, listener := range col.listeners {
-						event := funl.MakeListOfValues(req.frame, []funl.Value{{Kind: funl.StringValue, Data: "added"}, funl.MakeListOfValues(req.frame, []funl.Value{req.reqData})})
-						func() {
-							defer func() {
-								recover()
-							}()
-
-							funl.HandleCallOP(req.frame, []*funl.Item{
-								listener,
-								{Type: funl.ValueItem, Data: event},
-							})
-						}()
-					}
-				}
+			if storeErr == nil {
+				col.emit(req.frame, ev)
+				col.emit(req.frame, evictEv)
+			}
+
+			req.replyCh <- replyVal
+			if storeErr == nil {
+				col.notifyWaiters()
 			}
 
+		case putValuesReq:
+			replyVal, stored := col.putValues(req.frame, listValues(req.reqData), req.ttl)
 			req.replyCh <- replyVal
+			if stored {
+				col.notifyWaiters()
+			}
+
+		case takeByKeyReq, takeByIDReq:
+			if req.reqType == takeByKeyReq {
+				if key, ok := valueKey(req.frame, req.reqData); ok {
+					req.itemID = col.keys[key]
+				}
+			}
+			oldv, found := col.takeItem(req.frame, req.itemID)
+			if !found {
+				req.replyCh <- notFoundReply(req.frame, "")
+				break reqSwitch
+			}
+			req.replyCh <- funl.MakeListOfValues(req.frame, []funl.Value{{Kind: funl.BoolValue, Data: true}, oldv})
+			col.notifyWaiters()
+
+		case waitTakeReq, awaitReq:
+			var w *waiter
+			if req.reqType == waitTakeReq {
+				w = col.takeWaiter(req.frame, req.reqData, req.replyCh, req.errCh)
+			} else {
+				w = col.awaitWaiter(req.frame, req.reqData, req.replyCh, req.errCh)
+			}
+			if !w.serve() {
+				if req.timeout == 0 {
+					req.replyCh <- w.fail(req.frame, "")
+					break reqSwitch
+				}
+				col.waiters = append(col.waiters, w)
+			}
+
+		case cancelWaitReq:
+			col.cancelWaiter(req.frame, req.waitCh)
+			req.replyCh <- funl.Value{Kind: funl.BoolValue, Data: true}
+
+		case replaceByIDReq:
+			oldv, found := col.Items[req.itemID]
+			if !found {
+				replyValues := []funl.Value{
+					{
+						Kind: funl.BoolValue,
+						Data: false,
+					},
+					{
+						Kind: funl.StringValue,
+						Data: fmt.Sprintf("item not found (%s)", req.itemID),
+					},
+				}
+				req.replyCh <- funl.MakeListOfValues(req.frame, replyValues)
+				break reqSwitch
+			}
+			if keyErr := col.checkKeys(req.frame, map[string]funl.Value{req.itemID: req.reqData}, nil); keyErr != "" {
+				replyValues := []funl.Value{
+					{
+						Kind: funl.BoolValue,
+						Data: false,
+					},
+					{
+						Kind: funl.StringValue,
+						Data: keyErr,
+					},
+				}
+				req.replyCh <- funl.MakeListOfValues(req.frame, replyValues)
+				break reqSwitch
+			}
+
+			ev := newItemsEvent("updated", []eventItem{{id: req.itemID, val: req.reqData, oldVal: oldv}})
+
+			// to storage
+			replyCh := make(chan error)
+			chItem := changeItem{
+				ChType:  newValue,
+				Key:     req.itemID,
+				Val:     &req.reqData,
+				ColName: col.colName,
+			}
+			col.Db.Ch <- changes{Changelist: col.logChange(req.frame, []changeItem{chItem}, ev), ReplyCh: replyCh}
+			storeErr := <-replyCh
+
+			var errText string
+			if storeErr != nil {
+				errText = fmt.Sprintf("Put to persistent store failed: %v", storeErr)
+			} else {
+				col.Lock()
+				col.setItem(req.frame, req.itemID, req.reqData)
+				col.InvalidateList()
+				col.Unlock()
+				col.latestSnapshot = nil
+
+				col.emit(req.frame, ev)
+			}
+			replyValues := []funl.Value{
+				{
+					Kind: funl.BoolValue,
+					Data: storeErr == nil,
+				},
+				{
+					Kind: funl.StringValue,
+					Data: errText,
+				},
+			}
+			req.replyCh <- funl.MakeListOfValues(req.frame, replyValues)
+			if storeErr == nil {
+				col.notifyWaiters()
+			}
 
 		case takeReq:
 			// no need for any kind of locking yet
@@ -320,7 +983,13 @@ func (col *OpaqueCol) Run(frame *funl.Frame) {
 			}
 			var takenIDs []string
 			var results []funl.Value
-			for k, v := range col.Items {
+			candidates := col.Items
+			if req.pattern != nil {
+				// pattern is evaluated without calling filter function
+				takenIDs, results = req.pattern.selectItems(req.frame, col.Items, col.indexes)
+				candidates = nil
+			}
+			for k, v := range candidates {
 				argsForCall := []*funl.Item{
 					filterFunc,
 					{
@@ -371,7 +1040,12 @@ func (col *OpaqueCol) Run(frame *funl.Frame) {
 				}
 				chlist = append(chlist, chItem)
 			}
-			col.Db.Ch <- changes{Changelist: chlist, ReplyCh: replyCh}
+			deleted := make([]eventItem, len(takenIDs))
+			for i, itemID := range takenIDs {
+				deleted[i] = eventItem{id: itemID, val: results[i]}
+			}
+			ev := newItemsEvent("deleted", deleted)
+			col.Db.Ch <- changes{Changelist: col.logChange(req.frame, chlist, ev), ReplyCh: replyCh}
 			storeErr := <-replyCh
 			committedToPersistent = (storeErr == nil)
 
@@ -382,29 +1056,16 @@ func (col *OpaqueCol) Run(frame *funl.Frame) {
 			// now lock
 			col.Lock()
 			for _, itemID := range takenIDs {
-				delete(col.Items, itemID)
+				col.removeItem(req.frame, itemID)
 			}
 			col.InvalidateList()
 			col.Unlock()
 			col.latestSnapshot = nil // could be optimized (if any deleted then invalidate)
 
-			if col.hasListeners() {
-				for _, listener := range col.listeners {
-					event := funl.MakeListOfValues(req.frame, []funl.Value{{Kind: funl.StringValue, Data: "deleted"}, funl.MakeListOfValues(req.frame, results)})
-					func() {
-						defer func() {
-							recover()
-						}()
-
-						funl.HandleCallOP(req.frame, []*funl.Item{
-							listener,
-							{Type: funl.ValueItem, Data: event},
-						})
-					}()
-				}
-			}
+			col.emit(req.frame, ev)
 
 			req.replyCh <- funl.MakeListOfValues(req.frame, results)
+			col.notifyWaiters()
 
 		case updateReq:
 			// no need for any kind of locking yet
@@ -413,7 +1074,8 @@ func (col *OpaqueCol) Run(frame *funl.Frame) {
 				Data: req.reqData,
 			}
 			newMap := make(map[string]funl.Value)
-			updated := []funl.Value{}
+			updated := []eventItem{}
+			var updatedIDs []string
 			var isAnyUpdates bool
 			for k, v := range col.Items {
 				argsForCall := []*funl.Item{
@@ -446,13 +1108,23 @@ func (col *OpaqueCol) Run(frame *funl.Frame) {
 				}
 				if doUpdate {
 					newMap[k] = newValue
-					updated = append(updated, funl.MakeListOfValues(req.frame, []funl.Value{v, newValue}))
+					updated = append(updated, eventItem{id: k, val: newValue, oldVal: v})
+					updatedIDs = append(updatedIDs, k)
 					isAnyUpdates = true
 				} else {
 					newMap[k] = v
 				}
 			}
 			var commitUpdates bool
+			if isAnyUpdates && col.isKeyed() {
+				updatedM := make(map[string]funl.Value)
+				for _, itemID := range updatedIDs {
+					updatedM[itemID] = newMap[itemID]
+				}
+				if col.checkKeys(req.frame, updatedM, nil) != "" {
+					isAnyUpdates = false
+				}
+			}
 			if isAnyUpdates {
 				// to storage
 				replyCh := make(chan error)
@@ -467,37 +1139,29 @@ func (col *OpaqueCol) Run(frame *funl.Frame) {
 					}
 					chlist = append(chlist, chItem)
 				}
-				col.Db.Ch <- changes{Changelist: chlist, ReplyCh: replyCh}
+				ev := newItemsEvent("updated", updated)
+				col.Db.Ch <- changes{Changelist: col.logChange(req.frame, chlist, ev), ReplyCh: replyCh}
 				storeErr := <-replyCh
 				commitUpdates = (storeErr == nil)
 
 				if commitUpdates {
 					// now lock
 					col.Lock()
-					col.Items = newMap
+					for _, itemID := range updatedIDs {
+						col.setItem(req.frame, itemID, newMap[itemID])
+					}
 					col.InvalidateList()
 					col.Unlock()
 					col.latestSnapshot = nil
 
-					if col.hasListeners() {
-						for _, listener := range col.listeners {
-							event := funl.MakeListOfValues(req.frame, []funl.Value{{Kind: funl.StringValue, Data: "updated"}, funl.MakeListOfValues(req.frame, updated)})
-							func() {
-								defer func() {
-									recover()
-								}()
-
-								funl.HandleCallOP(req.frame, []*funl.Item{
-									listener,
-									{Type: funl.ValueItem, Data: event},
-								})
-							}()
-						}
-					}
+					col.emit(req.frame, ev)
 
 				}
 			}
 			req.replyCh <- funl.Value{Kind: funl.BoolValue, Data: commitUpdates}
+			if commitUpdates {
+				col.notifyWaiters()
+			}
 
 		case transReq:
 			transProc := &funl.Item{
@@ -505,6 +1169,7 @@ func (col *OpaqueCol) Run(frame *funl.Frame) {
 				Data: req.reqData,
 			}
 			txn := newTxn(col, false)
+			txn.tag = req.tag
 			argsForCall := []*funl.Item{
 				transProc,
 				{
@@ -533,130 +1198,76 @@ func (col *OpaqueCol) Run(frame *funl.Frame) {
 				break reqSwitch
 			}
 			doCommit := retv.Data.(bool)
+			var failText string
+			if doCommit {
+				if keyErr := col.checkKeys(req.frame, txn.newM, txn.newDeleted); keyErr != "" {
+					doCommit = false
+					failText = keyErr
+				}
+			}
 			if doCommit {
 				// to storage
-				var committedToPersistent bool
 				replyCh := make(chan error)
-				var chlist []changeItem
-				for k, v := range txn.newM {
-					copyV := v
-					chItem := changeItem{
-						ChType:  newValue,
-						Key:     k,
-						Val:     &copyV,
-						ColName: col.colName,
-					}
-					chlist = append(chlist, chItem)
-				}
-				for itemID := range txn.newDeleted {
-					chItem := changeItem{
-						ChType:  delValue,
-						Key:     itemID,
-						Val:     nil,
-						ColName: col.colName,
-					}
-					chlist = append(chlist, chItem)
-				}
-				col.Db.Ch <- changes{Changelist: chlist, ReplyCh: replyCh}
+				col.Db.Ch <- changes{Changelist: col.txnChangelist(req.frame, txn), ReplyCh: replyCh}
 				storeErr := <-replyCh
-				committedToPersistent = (storeErr == nil)
-
-				if committedToPersistent {
-					deleted := []funl.Value{}
-					added := []funl.Value{}
-					updated := []funl.Value{}
-
-					if col.hasListeners() {
-						for delkey, _ := range txn.newDeleted {
-							delv, exists := col.Items[delkey]
-							if exists {
-								deleted = append(deleted, delv)
-							}
-						}
-						for newkey, newv := range txn.newM {
-							if _, found := txn.newDeleted[newkey]; found {
-								continue
-							}
-							if _, found := col.Items[newkey]; !found {
-								added = append(added, newv)
-							}
-						}
-						for newkey, newv := range txn.newUPD {
-							if _, found := txn.newDeleted[newkey]; found {
-								continue
-							}
-							if oldv, found := col.Items[newkey]; found {
-								updated = append(updated, funl.MakeListOfValues(req.frame, []funl.Value{oldv, newv}))
-							}
-						}
-					}
-
-					// to memory
-					col.Lock()
-					for k, v := range txn.newM {
-						col.Items[k] = v
-					}
-					for itemID := range txn.newDeleted {
-						delete(col.Items, itemID)
-					}
-					col.InvalidateList()
-					col.Unlock()
-					col.latestSnapshot = nil
-
-					if col.hasListeners() {
-						event := funl.MakeListOfValues(req.frame, []funl.Value{
-							{Kind: funl.StringValue, Data: "transaction"},
-							funl.MakeListOfValues(req.frame, []funl.Value{
-								{Kind: funl.StringValue, Data: "added"},
-								funl.MakeListOfValues(req.frame, added),
-							}),
-							funl.MakeListOfValues(req.frame, []funl.Value{
-								{Kind: funl.StringValue, Data: "updated"},
-								funl.MakeListOfValues(req.frame, updated),
-							}),
-							funl.MakeListOfValues(req.frame, []funl.Value{
-								{Kind: funl.StringValue, Data: "deleted"},
-								funl.MakeListOfValues(req.frame, deleted),
-							}),
-						})
-						for _, listener := range col.listeners {
-							func() {
-								defer func() {
-									recover()
-								}()
-
-								funl.HandleCallOP(req.frame, []*funl.Item{
-									listener,
-									{Type: funl.ValueItem, Data: event},
-								})
-							}()
-						}
-					}
 
+				if storeErr == nil {
+					col.applyTxn(req.frame, txn)
 				} else {
-					retv = funl.Value{Kind: funl.BoolValue, Data: false}
+					doCommit = false
+					failText = fmt.Sprintf("Transaction commit failed: %v", storeErr)
 				}
 			}
-			req.replyCh <- retv
+			// reply contains commit result and reason if not committed
+			req.replyCh <- funl.MakeListOfValues(req.frame, []funl.Value{
+				{Kind: funl.BoolValue, Data: doCommit},
+				{Kind: funl.StringValue, Data: failText},
+			})
+			if doCommit {
+				col.notifyWaiters()
+			}
 
-		case viewReq:
-			txn := newTxn(col, true)
-			if col.latestSnapshot == nil {
-				col.latestSnapshot = make(map[string]funl.Value)
-				for k, v := range col.Items {
-					col.latestSnapshot[k] = v
-				}
+		case lockReq:
+			// col is kept locked (no other requests are handled) until it's released,
+			// transaction given in release is applied to col
+			req.replyCh <- funl.Value{Kind: funl.BoolValue, Data: true}
+			txn := <-req.releaseCh
+			if txn != nil {
+				col.applyTxn(req.frame, txn)
+			}
+			req.replyCh <- funl.Value{Kind: funl.BoolValue, Data: true}
+			if txn != nil {
+				col.notifyWaiters()
 			}
-			txn.snapM = col.latestSnapshot
+
+		case viewReq:
+			txn := col.snapshotTxn()
 			req.replyCh <- funl.Value{Kind: funl.OpaqueValue, Data: txn}
 
 		default:
 			funl.RunTimeError2(req.frame, "invalid req: %#v", req)
 		}
+		col.scheduleSweep(frame)
 	}
 }
 
-func newOpaqueCol(frame *funl.Frame, colName string, dbVal *OpaqueDB) *OpaqueCol {
+// applyOptions sets col options given in new-col
+func (col *OpaqueCol) applyOptions(opts *colOptions) {
+	col.options = opts.optionsVal
+	col.keyPath = opts.keyPath
+	col.keyFunc = opts.keyFunc
+	col.keys = make(map[string]string)
+	col.changelog = opts.changelog
+	col.logMax = opts.logMax
+	col.maxItems = opts.maxItems
+	col.maxBytes = opts.maxBytes
+	col.sizes = make(map[string]int)
+	col.ttl = opts.ttl
+	col.expiry = make(map[string]*expiryEntry)
+	col.expiryQueue = nil
+}
+
+func newOpaqueCol(frame *funl.Frame, colName string, dbVal *OpaqueDB, opts *colOptions) *OpaqueCol {
 	col := &OpaqueCol{
 		Items:          make(map[string]funl.Value),
 		ch:             make(chan req),
@@ -664,8 +1275,10 @@ func newOpaqueCol(frame *funl.Frame, colName string, dbVal *OpaqueDB) *OpaqueCol
 		Db:             dbVal,
 		colName:        colName,
 		idCounter:      100,
-		listeners:      []*funl.Item{},
+		listeners:      []*listener{},
+		indexes:        make(map[string]*colIndex),
 	}
+	col.applyOptions(opts)
 	go col.Run(frame)
 	return col
 }
@@ -673,21 +1286,46 @@ func newOpaqueCol(frame *funl.Frame, colName string, dbVal *OpaqueDB) *OpaqueCol
 type reqType int
 
 const (
-	updateReq      = 1
-	putReq         = 2
-	takeReq        = 3
-	transReq       = 4
-	viewReq        = 5
-	delColReq      = 6
-	shutdownReq    = 7
-	asListReq      = 8
-	addListenerReq = 9
+	updateReq         = 1
+	putReq            = 2
+	takeReq           = 3
+	transReq          = 4
+	viewReq           = 5
+	delColReq         = 6
+	shutdownReq       = 7
+	asListReq         = 8
+	addListenerReq    = 9
+	addIndexReq       = 10
+	takeByIDReq       = 11
+	replaceByIDReq    = 12
+	takeByKeyReq      = 13
+	lockReq           = 14
+	waitTakeReq       = 15
+	cancelWaitReq     = 16
+	awaitReq          = 17
+	removeListenerReq = 18
+	listListenersReq  = 19
+	subscribeReq      = 20
+	colStatsReq       = 22
+	sweepReq          = 23
+	putValuesReq      = 24
 )
 
 type req struct {
-	reqType reqType
-	reqData funl.Value
-	replyCh chan funl.Value
-	frame   *funl.Frame
-	errCh   chan string
+	reqType   reqType
+	reqData   funl.Value
+	replyCh   chan funl.Value
+	frame     *funl.Frame
+	errCh     chan string
+	keyPath   []funl.Value
+	itemID    string
+	releaseCh chan *OpaqueTxn
+	timeout   int
+	waitCh    chan funl.Value
+	sub       *subscriber
+	listener  *listener
+	filter    *eventFilter
+	tag       string
+	pattern   *valuePattern
+	ttl       int // time-to-live given for put (milliseconds)
 }
@@ -0,0 +1,86 @@
+package fuvaluez
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/anssihalmeaho/funl/funl"
+)
+
+// OpaqueCursor is cursor for reading values of view snapshot in batches,
+// values are projected only when batch is read
+type OpaqueCursor struct {
+	sync.Mutex
+	colName string
+	items   map[string]funl.Value // snapshot of view
+	ids     []string              // ids of items selected when cursor was opened (in order)
+	fields  *projection
+	pos     int
+	closed  bool
+}
+
+// TypeName gives type name
+func (cur *OpaqueCursor) TypeName() string {
+	return "cursor"
+}
+
+// Str returns value as string
+func (cur *OpaqueCursor) Str() string {
+	return fmt.Sprintf("cursor:%s", cur.colName)
+}
+
+// Equals returns equality
+func (cur *OpaqueCursor) Equals(with funl.OpaqueAPI) bool {
+	other, ok := with.(*OpaqueCursor)
+	if !ok {
+		return false
+	}
+	return cur == other
+}
+
+// newCursor makes cursor for values of view selected by query
+func newCursor(frame *funl.Frame, view *OpaqueTxn, q *queryOptions) (*OpaqueCursor, error) {
+	view.RLock()
+	items := view.contents()
+	ids, err := q.selectIDs(frame, items, view.contentIndexes())
+	view.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	return &OpaqueCursor{colName: view.col.colName, items: items, ids: ids, fields: q.fields}, nil
+}
+
+// nextBatch returns next values (at most given amount), empty list is returned
+// when all values have been read
+func (cur *OpaqueCursor) nextBatch(frame *funl.Frame, size int) ([]funl.Value, error) {
+	cur.Lock()
+	defer cur.Unlock()
+
+	if cur.closed {
+		return nil, fmt.Errorf("cursor closed")
+	}
+	end := cur.pos + size
+	if end > len(cur.ids) {
+		end = len(cur.ids)
+	}
+	batch := make([]funl.Value, 0, end-cur.pos)
+	for _, itemID := range cur.ids[cur.pos:end] {
+		batch = append(batch, cur.fields.apply(frame, cur.items[itemID]))
+	}
+	cur.pos = end
+	return batch, nil
+}
+
+// close releases snapshot of cursor, returns false if it was closed already
+func (cur *OpaqueCursor) close() bool {
+	cur.Lock()
+	defer cur.Unlock()
+
+	if cur.closed {
+		return false
+	}
+	cur.closed = true
+	cur.items = nil
+	cur.ids = nil
+	return true
+}
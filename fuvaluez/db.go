@@ -26,7 +26,12 @@ type OpaqueDB struct {
 	AdminCh    chan adminOP
 	Closing    bool
 	encoderVal funl.Value
+	decoderVal funl.Value
 	inMemOnly  bool
+	store      *bolt.DB // persistent storage (nil for in-mem db)
+	dbEvents   *dbEventDispatcher
+
+	listenerErrHandler *funl.Item
 }
 
 type adminOP struct {
@@ -34,17 +39,22 @@ type adminOP struct {
 	replych chan error
 	colName string
 	col     *OpaqueCol
+	index   *colIndex
 }
 
 type chType int
 
 const newValue chType = 1
 const delValue chType = 2
+const logEvent chType = 3
+const expiryValue chType = 4
+const trimLog chType = 5
+const seqValue chType = 6
 
 type changeItem struct {
 	ChType  chType
-	Key     string      // id
-	Val     *funl.Value // nil in case of delValue
+	Key     string      // id (sequence number in case of logEvent, first kept sequence number in case of trimLog, latest sequence number in case of seqValue)
+	Val     *funl.Value // nil in case of delValue, event in case of logEvent, expiry time in case of expiryValue (nil removes expiry)
 	ColName string
 }
 
@@ -53,6 +63,21 @@ type changes struct {
 	Changelist []changeItem
 }
 
+// decode makes value from its serialized form in persistent storage
+func (db *OpaqueDB) decode(frame *funl.Frame, data []byte) funl.Value {
+	decArgs := []*funl.Item{
+		{
+			Type: funl.ValueItem,
+			Data: db.decoderVal,
+		},
+		{
+			Type: funl.ValueItem,
+			Data: funl.Value{Kind: funl.StringValue, Data: string(data)},
+		},
+	}
+	return funl.HandleCallOP(frame, decArgs)
+}
+
 // Start starts db
 func (db *OpaqueDB) Start(frame *funl.Frame) (bool, string) {
 	if db.Ch != nil {
@@ -70,6 +95,15 @@ func (db *OpaqueDB) Start(frame *funl.Frame) (bool, string) {
 	}
 	db.encoderVal = funl.HandleEvalOP(frame, []*funl.Item{encItem})
 
+	decItem := &funl.Item{
+		Type: funl.ValueItem,
+		Data: funl.Value{
+			Kind: funl.StringValue,
+			Data: "call(proc() import stdser import stdbytes proc(__s) b = call(stdbytes.str-to-bytes __s) _ _ __v = call(stdser.decode b): __v end end)",
+		},
+	}
+	db.decoderVal = funl.HandleEvalOP(frame, []*funl.Item{decItem})
+
 	var pStore *bolt.DB
 	if !db.inMemOnly {
 		var err error
@@ -77,20 +111,38 @@ func (db *OpaqueDB) Start(frame *funl.Frame) (bool, string) {
 		if err != nil {
 			return false, fmt.Sprintf("Storage opening failed: %v", err)
 		}
+		db.store = pStore
 
 		err = db.readAllcolsFromPersistent(pStore, frame)
 		if err != nil {
 			return false, fmt.Sprintf("Storage reading failed: %v", err)
 		}
 	}
+	db.dbEvents = newDBEventDispatcher(db, frame)
 	go db.run(pStore, frame)
 	return true, ""
 }
 
-func (db *OpaqueDB) addColToPersistent(boltDB *bolt.DB, colName string, col *OpaqueCol) error {
+func (db *OpaqueDB) addColToPersistent(boltDB *bolt.DB, frame *funl.Frame, colName string, col *OpaqueCol) error {
 	if db.inMemOnly {
 		return nil
 	}
+	// col options are stored as value for col name
+	optionsData := []byte{}
+	if col.options.Kind == funl.MapValue {
+		encArgs := []*funl.Item{
+			{
+				Type: funl.ValueItem,
+				Data: db.encoderVal,
+			},
+			{
+				Type: funl.ValueItem,
+				Data: col.options,
+			},
+		}
+		res := funl.HandleCallOP(frame, encArgs)
+		optionsData = []byte(res.Data.(string))
+	}
 	return boltDB.Update(func(tx *bolt.Tx) error {
 		_, err := tx.CreateBucket([]byte(colName))
 		if err != nil {
@@ -101,15 +153,47 @@ func (db *OpaqueDB) addColToPersistent(boltDB *bolt.DB, colName string, col *Opa
 		if err != nil {
 			return err
 		}
-		if err := b.Put([]byte(colName), []byte{}); err != nil {
+		if err := b.Put([]byte(colName), optionsData); err != nil {
 			return err
 		}
 		return nil
 	})
 }
 
+func (db *OpaqueDB) addIndexToPersistent(boltDB *bolt.DB, frame *funl.Frame, colName string, idx *colIndex) error {
+	if db.inMemOnly {
+		return nil
+	}
+	keyPathVal := funl.MakeListOfValues(frame, idx.keyPath)
+	encArgs := []*funl.Item{
+		{
+			Type: funl.ValueItem,
+			Data: db.encoderVal,
+		},
+		{
+			Type: funl.ValueItem,
+			Data: keyPathVal,
+		},
+	}
+	res := funl.HandleCallOP(frame, encArgs)
+	value := res.Data.(string)
+
+	return boltDB.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte("__indexes"))
+		if err != nil {
+			return err
+		}
+		colIndexes, err := b.CreateBucketIfNotExists([]byte(colName))
+		if err != nil {
+			return err
+		}
+		return colIndexes.Put([]byte(idx.name), []byte(value))
+	})
+}
+
 func (db *OpaqueDB) readAllcolsFromPersistent(boltDB *bolt.DB, frame *funl.Frame) (err error) {
 	var colNames []string
+	colOptionsData := make(map[string]string)
 
 	err = boltDB.View(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte("__cols"))
@@ -118,6 +202,7 @@ func (db *OpaqueDB) readAllcolsFromPersistent(boltDB *bolt.DB, frame *funl.Frame
 		}
 		return b.ForEach(func(k, v []byte) error {
 			colNames = append(colNames, string(k))
+			colOptionsData[string(k)] = string(v)
 			return nil
 		})
 	})
@@ -125,14 +210,7 @@ func (db *OpaqueDB) readAllcolsFromPersistent(boltDB *bolt.DB, frame *funl.Frame
 		return
 	}
 
-	decItem := &funl.Item{
-		Type: funl.ValueItem,
-		Data: funl.Value{
-			Kind: funl.StringValue,
-			Data: "call(proc() import stdser import stdbytes proc(__s) b = call(stdbytes.str-to-bytes __s) _ _ __v = call(stdser.decode b): __v end end)",
-		},
-	}
-	decoderVal := funl.HandleEvalOP(frame, []*funl.Item{decItem})
+	decoderVal := db.decoderVal
 
 	db.Lock()
 	defer db.Unlock()
@@ -150,7 +228,28 @@ func (db *OpaqueDB) readAllcolsFromPersistent(boltDB *bolt.DB, frame *funl.Frame
 				latestSnapshot: nil,
 				Db:             db,
 				colName:        colName,
+				indexes:        make(map[string]*colIndex),
+			}
+
+			opts := &colOptions{}
+			if optionsData := colOptionsData[colName]; optionsData != "" {
+				decArgs := []*funl.Item{
+					{
+						Type: funl.ValueItem,
+						Data: decoderVal,
+					},
+					{
+						Type: funl.ValueItem,
+						Data: funl.Value{Kind: funl.StringValue, Data: optionsData},
+					},
+				}
+				optsVal := funl.HandleCallOP(frame, decArgs)
+				var optsErr error
+				if opts, optsErr = parseColOptions(frame, optsVal); optsErr != nil {
+					return fmt.Errorf("invalid options for col (%s): %v", colName, optsErr)
+				}
 			}
+			col.applyOptions(opts)
 
 			var biggestID int
 			kvErr := colBucket.ForEach(func(k, v []byte) error {
@@ -176,6 +275,7 @@ func (db *OpaqueDB) readAllcolsFromPersistent(boltDB *bolt.DB, frame *funl.Frame
 				res := funl.HandleCallOP(frame, decArgs)
 
 				col.Items[idVal] = res
+				col.setSize(idVal, len(v))
 
 				return nil
 			})
@@ -183,6 +283,85 @@ func (db *OpaqueDB) readAllcolsFromPersistent(boltDB *bolt.DB, frame *funl.Frame
 				return kvErr
 			}
 
+			col.order.reset(col.Items)
+
+			// read expiry times of items
+			if expiryBucket := tx.Bucket([]byte("__expiry")); expiryBucket != nil {
+				if colExpiry := expiryBucket.Bucket([]byte(colName)); colExpiry != nil {
+					expiryErr := colExpiry.ForEach(func(k, v []byte) error {
+						expiry, err := parseExpiry(v)
+						if err != nil {
+							return err
+						}
+						if _, found := col.Items[string(k)]; found {
+							col.setExpiry(string(k), expiry)
+						}
+						return nil
+					})
+					if expiryErr != nil {
+						return expiryErr
+					}
+				}
+			}
+
+			// rebuild primary keys and indexes
+			if col.isKeyed() {
+				for itemID, itemVal := range col.Items {
+					if key, ok := col.keyOf(frame, itemVal); ok {
+						col.keys[key] = itemID
+					}
+				}
+			}
+			if indexesBucket := tx.Bucket([]byte("__indexes")); indexesBucket != nil {
+				if colIndexes := indexesBucket.Bucket([]byte(colName)); colIndexes != nil {
+					idxErr := colIndexes.ForEach(func(k, v []byte) error {
+						decArgs := []*funl.Item{
+							{
+								Type: funl.ValueItem,
+								Data: decoderVal,
+							},
+							{
+								Type: funl.ValueItem,
+								Data: funl.Value{Kind: funl.StringValue, Data: string(v)},
+							},
+						}
+						keyPathVal := funl.HandleCallOP(frame, decArgs)
+
+						idx := newColIndex(string(k), keyPathFromValue(keyPathVal))
+						for itemID, itemVal := range col.Items {
+							idx.add(frame, itemID, itemVal)
+						}
+						col.indexes[idx.name] = idx
+						return nil
+					})
+					if idxErr != nil {
+						return idxErr
+					}
+				}
+			}
+
+			// latest sequence number is stored with col options (change log events are read when needed)
+			if seqBucket := tx.Bucket([]byte("__seq")); seqBucket != nil {
+				if v := seqBucket.Get([]byte(colName)); v != nil {
+					seq, seqErr := strconv.Atoi(string(v))
+					if seqErr != nil {
+						return seqErr
+					}
+					col.seq = seq
+				}
+			}
+			if colLog := logBucket(tx, colName); colLog != nil {
+				if k, _ := colLog.Cursor().Last(); k != nil {
+					seq, seqErr := strconv.Atoi(string(k))
+					if seqErr != nil {
+						return seqErr
+					}
+					if seq > col.seq {
+						col.seq = seq
+					}
+				}
+			}
+
 			col.idCounter = biggestID + 1
 			db.cols[colName] = col
 			go col.Run(frame)
@@ -214,14 +393,62 @@ func (db *OpaqueDB) putKVtoPersistent(tx *bolt.Tx, frame *funl.Frame, colName st
 	return colBucket.Put([]byte(key), []byte(value))
 }
 
+// putLogEventToPersistent writes event to change log of col
+func (db *OpaqueDB) putLogEventToPersistent(tx *bolt.Tx, frame *funl.Frame, colName string, seqKey string, event funl.Value) error {
+	logsBucket, err := tx.CreateBucketIfNotExists([]byte("__changelog"))
+	if err != nil {
+		return err
+	}
+	colLog, err := logsBucket.CreateBucketIfNotExists([]byte(colName))
+	if err != nil {
+		return err
+	}
+
+	encArgs := []*funl.Item{
+		{
+			Type: funl.ValueItem,
+			Data: db.encoderVal,
+		},
+		{
+			Type: funl.ValueItem,
+			Data: event,
+		},
+	}
+	res := funl.HandleCallOP(frame, encArgs)
+	return colLog.Put([]byte(seqKey), []byte(res.Data.(string)))
+}
+
 func (db *OpaqueDB) delKVfromPersistent(tx *bolt.Tx, frame *funl.Frame, colName string, key string) error {
 	colBucket := tx.Bucket([]byte(colName))
 	if colBucket == nil {
 		return fmt.Errorf("col not found (%s)", colName)
 	}
+	if expiryBucket := tx.Bucket([]byte("__expiry")); expiryBucket != nil {
+		if colExpiry := expiryBucket.Bucket([]byte(colName)); colExpiry != nil {
+			if err := colExpiry.Delete([]byte(key)); err != nil {
+				return err
+			}
+		}
+	}
 	return colBucket.Delete([]byte(key))
 }
 
+// putExpiryToPersistent writes expiry time of item (nil value removes expiry)
+func (db *OpaqueDB) putExpiryToPersistent(tx *bolt.Tx, colName string, key string, expiry *funl.Value) error {
+	expiryBucket, err := tx.CreateBucketIfNotExists([]byte("__expiry"))
+	if err != nil {
+		return err
+	}
+	colExpiry, err := expiryBucket.CreateBucketIfNotExists([]byte(colName))
+	if err != nil {
+		return err
+	}
+	if expiry == nil {
+		return colExpiry.Delete([]byte(key))
+	}
+	return colExpiry.Put([]byte(key), []byte(strconv.Itoa(expiry.Data.(int))))
+}
+
 func (db *OpaqueDB) consistentChangeWrites(boltDB *bolt.DB, frame *funl.Frame, changelist []changeItem) error {
 	if db.inMemOnly {
 		return nil
@@ -242,6 +469,30 @@ func (db *OpaqueDB) consistentChangeWrites(boltDB *bolt.DB, frame *funl.Frame, c
 				if err != nil {
 					return err
 				}
+
+			case logEvent:
+				err := db.putLogEventToPersistent(tx, frame, chItem.ColName, chItem.Key, *chItem.Val)
+				if err != nil {
+					return err
+				}
+
+			case expiryValue:
+				err := db.putExpiryToPersistent(tx, chItem.ColName, chItem.Key, chItem.Val)
+				if err != nil {
+					return err
+				}
+
+			case trimLog:
+				err := db.trimLogInPersistent(tx, chItem.ColName, chItem.Key)
+				if err != nil {
+					return err
+				}
+
+			case seqValue:
+				err := db.putSeqToPersistent(tx, chItem.ColName, chItem.Key)
+				if err != nil {
+					return err
+				}
 			}
 		}
 		return nil
@@ -261,6 +512,33 @@ func (db *OpaqueDB) delColFromPersistent(boltDB *bolt.DB, colName string, col *O
 			return err
 		}
 		errRemoFrom := b.Delete([]byte(colName))
+
+		if indexesBucket := tx.Bucket([]byte("__indexes")); indexesBucket != nil {
+			if indexesBucket.Bucket([]byte(colName)) != nil {
+				if err := indexesBucket.DeleteBucket([]byte(colName)); err != nil {
+					return err
+				}
+			}
+		}
+		if logsBucket := tx.Bucket([]byte("__changelog")); logsBucket != nil {
+			if logsBucket.Bucket([]byte(colName)) != nil {
+				if err := logsBucket.DeleteBucket([]byte(colName)); err != nil {
+					return err
+				}
+			}
+		}
+		if expiryBucket := tx.Bucket([]byte("__expiry")); expiryBucket != nil {
+			if expiryBucket.Bucket([]byte(colName)) != nil {
+				if err := expiryBucket.DeleteBucket([]byte(colName)); err != nil {
+					return err
+				}
+			}
+		}
+		if seqBucket := tx.Bucket([]byte("__seq")); seqBucket != nil {
+			if err := seqBucket.Delete([]byte(colName)); err != nil {
+				return err
+			}
+		}
 		if errDelB != nil {
 			return errDelB
 		}
@@ -296,8 +574,10 @@ func (db *OpaqueDB) run(boltDB *bolt.DB, frame *funl.Frame) {
 				}
 			}
 			if allColsSuspended {
-				closeReplych <- db.closePersistent(boltDB) // reply to close requester
-				return                                     // exit from db handler
+				closeErr := db.closePersistent(boltDB)
+				db.dbEvents.post("closed", db.name)
+				closeReplych <- closeErr // reply to close requester
+				return                   // exit from db handler
 			}
 		}
 
@@ -322,6 +602,7 @@ func (db *OpaqueDB) run(boltDB *bolt.DB, frame *funl.Frame) {
 				}
 				db.Closing = true
 				closeReplych = adminOp.replych
+				db.dbEvents.post("closing", db.name)
 
 				for colName, col := range db.cols {
 					waitCols[colName] = false
@@ -351,18 +632,25 @@ func (db *OpaqueDB) run(boltDB *bolt.DB, frame *funl.Frame) {
 					adminOp.replych <- fmt.Errorf("db closing, add new col rejected")
 					break reqSwitch
 				}
-				err := db.addColToPersistent(boltDB, adminOp.colName, adminOp.col)
+				err := db.addColToPersistent(boltDB, frame, adminOp.colName, adminOp.col)
 				if err == nil {
 					db.addCol(adminOp.col, adminOp.colName)
+					db.dbEvents.post("col-created", adminOp.colName)
 				}
 				adminOp.replych <- err
 
+			case "add-index":
+				adminOp.replych <- db.addIndexToPersistent(boltDB, frame, adminOp.colName, adminOp.index)
+
 			case "del-col":
 				err := db.delColFromPersistent(boltDB, adminOp.colName, adminOp.col)
 				db.delCol(adminOp.colName)
 				if db.Closing {
 					waitCols[adminOp.colName] = true
 				}
+				if err == nil {
+					db.dbEvents.post("col-deleted", adminOp.colName)
+				}
 				adminOp.replych <- err
 
 			default:
@@ -0,0 +1,179 @@
+package fuvaluez
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/anssihalmeaho/funl/funl"
+)
+
+// dbListener is procedure registered to get db events
+type dbListener struct {
+	id          int
+	proc        *funl.Item
+	maxFailures int // listener is removed after this many consecutive failures (0 = never)
+	failures    int // consecutive failures
+}
+
+func parseDBListenerOptions(frame *funl.Frame, optsVal funl.Value) (*dbListener, error) {
+	l := &dbListener{}
+	err := forOptions(frame, optsVal, func(keyStr string, valv funl.Value) error {
+		switch keyStr {
+		case "max-failures":
+			if valv.Kind != funl.IntValue || valv.Data.(int) < 1 {
+				return fmt.Errorf("%s value not positive int: %v", keyStr, valv)
+			}
+			l.maxFailures = valv.Data.(int)
+		default:
+			return fmt.Errorf("unknown option: %s", keyStr)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// OpaqueDBListener is handle for db listener given to listener error handler
+type OpaqueDBListener struct {
+	db *OpaqueDB
+	id int
+}
+
+// TypeName gives type name
+func (lh *OpaqueDBListener) TypeName() string {
+	return "db-listener"
+}
+
+// Str returns value as string
+func (lh *OpaqueDBListener) Str() string {
+	return fmt.Sprintf("db-listener:%s:%d", lh.db.name, lh.id)
+}
+
+// Equals returns equality
+func (lh *OpaqueDBListener) Equals(with funl.OpaqueAPI) bool {
+	other, ok := with.(*OpaqueDBListener)
+	if !ok {
+		return false
+	}
+	return lh.db == other.db && lh.id == other.id
+}
+
+// dbEventDispatcher calls db listeners asynchronously,
+// events are given in same order as those happened
+type dbEventDispatcher struct {
+	sync.Mutex
+	cond      *sync.Cond
+	db        *OpaqueDB
+	frame     *funl.Frame
+	listeners []*dbListener
+	counter   int
+	queue     []dbEvent
+	stopped   bool
+	doneCh    chan struct{} // closed when all events are dispatched after stop
+}
+
+type dbEvent struct {
+	evType string // 'col-created', 'col-deleted', 'closing' or 'closed'
+	name   string // col name or db name
+}
+
+func newDBEventDispatcher(db *OpaqueDB, frame *funl.Frame) *dbEventDispatcher {
+	// listeners are called in own frame of dispatcher fiber
+	dispFrame := funl.NewTopFrameWithInterpreter(frame.Interpreter)
+	dispFrame.SetInProcCall(true)
+	d := &dbEventDispatcher{
+		db:     db,
+		frame:  dispFrame,
+		doneCh: make(chan struct{}),
+	}
+	d.cond = sync.NewCond(d)
+	go d.run()
+	return d
+}
+
+func (d *dbEventDispatcher) addListener(proc funl.Value, l *dbListener) {
+	if l == nil {
+		l = &dbListener{}
+	}
+	d.Lock()
+	defer d.Unlock()
+	d.counter++
+	l.id = d.counter
+	l.proc = &funl.Item{Type: funl.ValueItem, Data: proc}
+	d.listeners = append(d.listeners, l)
+}
+
+// removeListener removes listener (after too many failures)
+func (d *dbEventDispatcher) removeListener(id int) {
+	d.Lock()
+	defer d.Unlock()
+	for i, l := range d.listeners {
+		if l.id == id {
+			d.listeners = append(d.listeners[:i:i], d.listeners[i+1:]...)
+			return
+		}
+	}
+}
+
+// post puts event to queue, 'closed' event is last one
+func (d *dbEventDispatcher) post(evType string, name string) {
+	d.Lock()
+	defer d.Unlock()
+	if d.stopped {
+		return
+	}
+	d.queue = append(d.queue, dbEvent{evType: evType, name: name})
+	if evType == "closed" {
+		d.stopped = true
+	}
+	d.cond.Signal()
+}
+
+// waitDone waits until all events are dispatched after 'closed' event
+func (d *dbEventDispatcher) waitDone() {
+	<-d.doneCh
+}
+
+func (d *dbEventDispatcher) run() {
+	for {
+		d.Lock()
+		for len(d.queue) == 0 && !d.stopped {
+			d.cond.Wait()
+		}
+		if len(d.queue) == 0 {
+			d.Unlock()
+			close(d.doneCh)
+			return
+		}
+		ev := d.queue[0]
+		d.queue = d.queue[1:]
+		listeners := append([]*dbListener{}, d.listeners...)
+		d.Unlock()
+
+		for _, l := range listeners {
+			d.callListener(l, ev)
+		}
+	}
+}
+
+// callListener calls listener with event, error handler of db is called
+// if listener makes RTE
+func (d *dbEventDispatcher) callListener(l *dbListener, ev dbEvent) {
+	event := funl.MakeListOfValues(d.frame, []funl.Value{
+		{Kind: funl.StringValue, Data: ev.evType},
+		{Kind: funl.StringValue, Data: ev.name},
+	})
+	errText := callWithRecover(d.frame, l.proc, event)
+	if errText == "" {
+		l.failures = 0
+		return
+	}
+	l.failures++
+	handle := &OpaqueDBListener{db: d.db, id: l.id}
+	d.db.handleListenerError(d.frame, funl.Value{Kind: funl.OpaqueValue, Data: handle}, event, errText)
+	if l.maxFailures > 0 && l.failures >= l.maxFailures {
+		d.removeListener(l.id)
+	}
+}
@@ -0,0 +1,181 @@
+package fuvaluez
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/anssihalmeaho/funl/funl"
+)
+
+// colLock is col kept locked during operation which concerns several cols
+type colLock struct {
+	col       *OpaqueCol
+	replyCh   chan funl.Value
+	releaseCh chan *OpaqueTxn
+}
+
+// lockCols locks cols one by one in order of names (so that
+// concurrent lockings don't deadlock)
+func lockCols(frame *funl.Frame, db *OpaqueDB, colNames []string) ([]*colLock, error) {
+	nameSet := make(map[string]bool)
+	var names []string
+	for _, colName := range colNames {
+		if !nameSet[colName] {
+			nameSet[colName] = true
+			names = append(names, colName)
+		}
+	}
+	sort.Strings(names)
+
+	var locks []*colLock
+	for _, colName := range names {
+		col, found := db.getCol(colName)
+		if !found {
+			releaseCols(locks, nil)
+			return nil, fmt.Errorf("col not found (%s)", colName)
+		}
+		lock := &colLock{
+			col:       col,
+			replyCh:   make(chan funl.Value),
+			releaseCh: make(chan *OpaqueTxn),
+		}
+		request := &req{
+			reqType:   lockReq,
+			replyCh:   lock.replyCh,
+			frame:     frame,
+			releaseCh: lock.releaseCh,
+		}
+		col.ch <- *request
+		if reply := <-lock.replyCh; reply.Kind != funl.BoolValue {
+			releaseCols(locks, nil)
+			return nil, fmt.Errorf("col closed (%s)", colName)
+		}
+		locks = append(locks, lock)
+	}
+	return locks, nil
+}
+
+// releaseCols releases locked cols, transactions (if given)
+// are applied to cols
+func releaseCols(locks []*colLock, txns map[*OpaqueCol]*OpaqueTxn) {
+	for _, lock := range locks {
+		lock.releaseCh <- txns[lock.col]
+		<-lock.replyCh
+	}
+}
+
+// runDBTrans runs transaction procedure for several cols and commits
+// changes of all cols in one write to persistent storage,
+// returns also reason if changes were not committed (empty if cancelled)
+func runDBTrans(frame *funl.Frame, db *OpaqueDB, colNames []string, transProc funl.Value, tag string) (bool, string, error) {
+	locks, err := lockCols(frame, db, colNames)
+	if err != nil {
+		return false, "", err
+	}
+
+	txns := make(map[*OpaqueCol]*OpaqueTxn)
+	var mapItems []*funl.Item
+	for _, lock := range locks {
+		txn := newTxn(lock.col, false)
+		txn.tag = tag
+		txns[lock.col] = txn
+		mapItems = append(mapItems,
+			&funl.Item{Type: funl.ValueItem, Data: funl.Value{Kind: funl.StringValue, Data: lock.col.colName}},
+			&funl.Item{Type: funl.ValueItem, Data: funl.Value{Kind: funl.OpaqueValue, Data: txn}},
+		)
+	}
+	argsForCall := []*funl.Item{
+		{
+			Type: funl.ValueItem,
+			Data: transProc,
+		},
+		{
+			Type: funl.ValueItem,
+			Data: funl.HandleMapOP(frame, mapItems),
+		},
+	}
+	retv, callErr := func() (rv funl.Value, errDesc string) {
+		defer func() {
+			if r := recover(); r != nil {
+				var rtestr string
+				if err, isError := r.(error); isError {
+					rtestr = err.Error()
+				}
+				errDesc = fmt.Sprintf("handler made RTE: %s", rtestr)
+			}
+		}()
+		return funl.HandleCallOP(frame, argsForCall), ""
+	}()
+	if callErr != "" {
+		releaseCols(locks, nil)
+		return false, "", fmt.Errorf("%s", callErr)
+	}
+	if retv.Kind != funl.BoolValue {
+		releaseCols(locks, nil)
+		return false, "", fmt.Errorf("txn proc returned non-bool value")
+	}
+
+	if !retv.Data.(bool) {
+		releaseCols(locks, nil)
+		return false, "", nil
+	}
+	var chlist []changeItem
+	for _, lock := range locks {
+		txn := txns[lock.col]
+		if keyErr := lock.col.checkKeys(frame, txn.newM, txn.newDeleted); keyErr != "" {
+			releaseCols(locks, nil)
+			return false, fmt.Sprintf("%s: %s", lock.col.colName, keyErr), nil
+		}
+		chlist = append(chlist, lock.col.txnChangelist(frame, txn)...)
+	}
+
+	// to storage
+	replyCh := make(chan error)
+	db.Ch <- changes{Changelist: chlist, ReplyCh: replyCh}
+	if storeErr := <-replyCh; storeErr != nil {
+		releaseCols(locks, nil)
+		return false, fmt.Sprintf("Transaction commit failed: %v", storeErr), nil
+	}
+	releaseCols(locks, txns)
+	return true, "", nil
+}
+
+// snapshotCols makes views of cols so that all are from same point of time
+func snapshotCols(frame *funl.Frame, db *OpaqueDB, colNames []string) (map[string]*OpaqueTxn, error) {
+	locks, err := lockCols(frame, db, colNames)
+	if err != nil {
+		return nil, err
+	}
+	views := make(map[string]*OpaqueTxn)
+	for _, lock := range locks {
+		views[lock.col.colName] = lock.col.snapshotTxn()
+	}
+	releaseCols(locks, nil)
+	return views, nil
+}
+
+// runDBView calls view procedure with views of all cols in db
+func runDBView(frame *funl.Frame, db *OpaqueDB, viewProc funl.Value) (funl.Value, error) {
+	views, err := snapshotCols(frame, db, db.getColNames())
+	if err != nil {
+		return funl.Value{}, err
+	}
+	var mapItems []*funl.Item
+	for colName, view := range views {
+		mapItems = append(mapItems,
+			&funl.Item{Type: funl.ValueItem, Data: funl.Value{Kind: funl.StringValue, Data: colName}},
+			&funl.Item{Type: funl.ValueItem, Data: funl.Value{Kind: funl.OpaqueValue, Data: view}},
+		)
+	}
+	argsForCall := []*funl.Item{
+		{
+			Type: funl.ValueItem,
+			Data: viewProc,
+		},
+		{
+			Type: funl.ValueItem,
+			Data: funl.HandleMapOP(frame, mapItems),
+		},
+	}
+	return funl.HandleCallOP(frame, argsForCall), nil
+}
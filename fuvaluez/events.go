@@ -0,0 +1,361 @@
+package fuvaluez
+
+import (
+	"fmt"
+
+	"github.com/anssihalmeaho/funl/funl"
+)
+
+// event formats
+const (
+	formatPlain = "plain"
+	formatRich  = "rich"
+)
+
+// reasonEvicted is reason of deletion for items evicted from capped col
+const reasonEvicted = "evicted"
+
+// eventItem is changed item in event
+type eventItem struct {
+	id     string
+	val    funl.Value // added/deleted value or new value of updated item
+	oldVal funl.Value // old value of updated item
+}
+
+// colEvent is change event of col given to listeners and subscribers
+type colEvent struct {
+	evType  string      // 'added', 'updated', 'deleted' or 'transaction'
+	items   []eventItem // changed items (not in transaction)
+	changes []*colEvent // added, updated and deleted changes in transaction
+	seq     int         // commit sequence number
+	logged  bool        // true if event is in change log
+	time    int         // commit time (milliseconds since epoch)
+	tag     string      // transaction tag given in trans
+	reason  string      // reason of deletion ('evicted', 'expired' or empty)
+}
+
+func newItemsEvent(evType string, items []eventItem) *colEvent {
+	return &colEvent{evType: evType, items: items}
+}
+
+func newTransactionEvent(added, updated, deleted []eventItem) *colEvent {
+	return &colEvent{
+		evType: "transaction",
+		changes: []*colEvent{
+			newItemsEvent("added", added),
+			newItemsEvent("updated", updated),
+			newItemsEvent("deleted", deleted),
+		},
+	}
+}
+
+// toValue makes FunL value of event in plain format
+func (ev *colEvent) toValue(frame *funl.Frame) funl.Value {
+	items := []funl.Value{{Kind: funl.StringValue, Data: ev.evType}}
+	switch ev.evType {
+	case "transaction":
+		for _, change := range ev.changes {
+			items = append(items, change.toValue(frame))
+		}
+	case "updated":
+		updated := []funl.Value{}
+		for _, item := range ev.items {
+			updated = append(updated, funl.MakeListOfValues(frame, []funl.Value{item.oldVal, item.val}))
+		}
+		items = append(items, funl.MakeListOfValues(frame, updated))
+	default:
+		values := []funl.Value{}
+		for _, item := range ev.items {
+			values = append(values, item.val)
+		}
+		items = append(items, funl.MakeListOfValues(frame, values))
+		if ev.reason != "" {
+			items = append(items, funl.Value{Kind: funl.StringValue, Data: ev.reason})
+		}
+	}
+	// sequence number is always last item (after reason of deletion)
+	if ev.logged {
+		items = append(items, funl.Value{Kind: funl.IntValue, Data: ev.seq})
+	}
+	return funl.MakeListOfValues(frame, items)
+}
+
+// toRichValue makes FunL value of event in rich format (map with item ids and commit info)
+func (ev *colEvent) toRichValue(frame *funl.Frame) funl.Value {
+	mapItems := []*funl.Item{
+		strItem("type"), strItem(ev.evType),
+	}
+	if ev.evType == "transaction" {
+		for _, change := range ev.changes {
+			mapItems = append(mapItems, strItem(change.evType), valItem(change.richItems(frame)))
+		}
+		mapItems = append(mapItems, strItem("tag"), strItem(ev.tag))
+	} else {
+		mapItems = append(mapItems, strItem("items"), valItem(ev.richItems(frame)))
+		if ev.reason != "" {
+			mapItems = append(mapItems, strItem("reason"), strItem(ev.reason))
+		}
+	}
+	mapItems = append(mapItems,
+		strItem("seq"), valItem(funl.Value{Kind: funl.IntValue, Data: ev.seq}),
+		strItem("time"), valItem(funl.Value{Kind: funl.IntValue, Data: ev.time}),
+	)
+	return funl.HandleMapOP(frame, mapItems)
+}
+
+// richItems makes list of maps of changed items
+func (ev *colEvent) richItems(frame *funl.Frame) funl.Value {
+	values := []funl.Value{}
+	for _, item := range ev.items {
+		mapItems := []*funl.Item{strItem("id"), strItem(item.id)}
+		if ev.evType == "updated" {
+			mapItems = append(mapItems, strItem("old"), valItem(item.oldVal), strItem("new"), valItem(item.val))
+		} else {
+			mapItems = append(mapItems, strItem("value"), valItem(item.val))
+		}
+		values = append(values, funl.HandleMapOP(frame, mapItems))
+	}
+	return funl.MakeListOfValues(frame, values)
+}
+
+func strItem(s string) *funl.Item {
+	return &funl.Item{Type: funl.ValueItem, Data: funl.Value{Kind: funl.StringValue, Data: s}}
+}
+
+func valItem(v funl.Value) *funl.Item {
+	return &funl.Item{Type: funl.ValueItem, Data: v}
+}
+
+// listValues returns items of FunL list
+func listValues(lv funl.Value) []funl.Value {
+	var result []funl.Value
+	for iter := funl.NewListIterator(lv); ; {
+		next := iter.Next()
+		if next == nil {
+			return result
+		}
+		result = append(result, *next)
+	}
+}
+
+// mapField returns value of key in FunL map
+func mapField(frame *funl.Frame, m funl.Value, key string) (funl.Value, bool) {
+	return getByPath(frame, m, []funl.Value{{Kind: funl.StringValue, Data: key}})
+}
+
+// eventFromValue makes event from FunL value (made by toRichValue or by toValue)
+func eventFromValue(frame *funl.Frame, v funl.Value) (*colEvent, error) {
+	if v.Kind == funl.MapValue {
+		return eventFromRichValue(frame, v)
+	}
+	if v.Kind != funl.ListValue {
+		return nil, fmt.Errorf("event not a list: %v", v)
+	}
+	items := listValues(v)
+	if len(items) < 2 || items[0].Kind != funl.StringValue {
+		return nil, fmt.Errorf("invalid event: %v", v)
+	}
+	ev := &colEvent{evType: items[0].Data.(string)}
+	switch ev.evType {
+	case "transaction":
+		if len(items) < 4 {
+			return nil, fmt.Errorf("invalid event: %v", v)
+		}
+		for _, changeVal := range items[1:4] {
+			change, err := eventFromValue(frame, changeVal)
+			if err != nil {
+				return nil, err
+			}
+			ev.changes = append(ev.changes, change)
+		}
+	case "updated":
+		for _, pair := range listValues(items[1]) {
+			oldAndNew := listValues(pair)
+			if len(oldAndNew) != 2 {
+				return nil, fmt.Errorf("invalid update: %v", pair)
+			}
+			ev.items = append(ev.items, eventItem{oldVal: oldAndNew[0], val: oldAndNew[1]})
+		}
+	default:
+		for _, val := range listValues(items[1]) {
+			ev.items = append(ev.items, eventItem{val: val})
+		}
+		if len(items) > 2 && items[2].Kind == funl.StringValue {
+			ev.reason = items[2].Data.(string)
+		}
+	}
+	return ev, nil
+}
+
+func eventFromRichValue(frame *funl.Frame, v funl.Value) (*colEvent, error) {
+	typeVal, found := mapField(frame, v, "type")
+	if !found || typeVal.Kind != funl.StringValue {
+		return nil, fmt.Errorf("invalid event: %v", v)
+	}
+	ev := &colEvent{evType: typeVal.Data.(string)}
+	if timeVal, found := mapField(frame, v, "time"); found && timeVal.Kind == funl.IntValue {
+		ev.time = timeVal.Data.(int)
+	}
+	if ev.evType != "transaction" {
+		itemsVal, found := mapField(frame, v, "items")
+		if !found || itemsVal.Kind != funl.ListValue {
+			return nil, fmt.Errorf("invalid event: %v", v)
+		}
+		if reasonVal, found := mapField(frame, v, "reason"); found && reasonVal.Kind == funl.StringValue {
+			ev.reason = reasonVal.Data.(string)
+		}
+		var err error
+		ev.items, err = eventItemsFromValue(frame, ev.evType, itemsVal)
+		return ev, err
+	}
+	if tagVal, found := mapField(frame, v, "tag"); found && tagVal.Kind == funl.StringValue {
+		ev.tag = tagVal.Data.(string)
+	}
+	for _, changeType := range []string{"added", "updated", "deleted"} {
+		itemsVal, found := mapField(frame, v, changeType)
+		if !found || itemsVal.Kind != funl.ListValue {
+			return nil, fmt.Errorf("invalid event: %v", v)
+		}
+		items, err := eventItemsFromValue(frame, changeType, itemsVal)
+		if err != nil {
+			return nil, err
+		}
+		ev.changes = append(ev.changes, newItemsEvent(changeType, items))
+	}
+	return ev, nil
+}
+
+func eventItemsFromValue(frame *funl.Frame, evType string, itemsVal funl.Value) ([]eventItem, error) {
+	var items []eventItem
+	for _, itemVal := range listValues(itemsVal) {
+		idVal, found := mapField(frame, itemVal, "id")
+		if !found || idVal.Kind != funl.StringValue {
+			return nil, fmt.Errorf("invalid event item: %v", itemVal)
+		}
+		item := eventItem{id: idVal.Data.(string)}
+		if evType == "updated" {
+			oldVal, oldFound := mapField(frame, itemVal, "old")
+			newVal, newFound := mapField(frame, itemVal, "new")
+			if !oldFound || !newFound {
+				return nil, fmt.Errorf("invalid update: %v", itemVal)
+			}
+			item.oldVal, item.val = oldVal, newVal
+		} else {
+			val, found := mapField(frame, itemVal, "value")
+			if !found {
+				return nil, fmt.Errorf("invalid event item: %v", itemVal)
+			}
+			item.val = val
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+func (ev *colEvent) isEmpty() bool {
+	for _, change := range ev.changes {
+		if !change.isEmpty() {
+			return false
+		}
+	}
+	return len(ev.items) == 0
+}
+
+// eventFilter selects which events and values are delivered (and in which format)
+type eventFilter struct {
+	types  map[string]bool // nil means all types
+	filter *funl.Item      // nil means all values
+	rich   bool            // true if events are given in rich format
+}
+
+// setOption sets filter option, returns false if option is not for filter
+func (f *eventFilter) setOption(frame *funl.Frame, keyStr string, valv funl.Value) (bool, error) {
+	switch keyStr {
+	case "format":
+		if valv.Kind != funl.StringValue {
+			return true, fmt.Errorf("%s value not string: %v", keyStr, valv)
+		}
+		switch format := valv.Data.(string); format {
+		case formatPlain, formatRich:
+			f.rich = (format == formatRich)
+		default:
+			return true, fmt.Errorf("unknown format: %s", format)
+		}
+	case "filter":
+		if valv.Kind != funl.FunctionValue {
+			return true, fmt.Errorf("%s value not func: %v", keyStr, valv)
+		}
+		f.filter = &funl.Item{Type: funl.ValueItem, Data: valv}
+	case "events":
+		if valv.Kind != funl.ListValue {
+			return true, fmt.Errorf("%s value not list: %v", keyStr, valv)
+		}
+		f.types = make(map[string]bool)
+		for iter := funl.NewListIterator(valv); ; {
+			next := iter.Next()
+			if next == nil {
+				break
+			}
+			evType, isString := next.Data.(string)
+			if !isString || !isValidEventType(evType) {
+				return true, fmt.Errorf("invalid event type: %v", *next)
+			}
+			f.types[evType] = true
+		}
+	default:
+		return false, nil
+	}
+	return true, nil
+}
+
+func (f *eventFilter) isRich() bool {
+	return f != nil && f.rich
+}
+
+// eventValue makes FunL value of event in format selected for filter
+func (f *eventFilter) eventValue(frame *funl.Frame, ev *colEvent) funl.Value {
+	if f.isRich() {
+		return ev.toRichValue(frame)
+	}
+	return ev.toValue(frame)
+}
+
+func isValidEventType(evType string) bool {
+	switch evType {
+	case "added", "updated", "deleted", "transaction":
+		return true
+	}
+	return false
+}
+
+func (f *eventFilter) isMatch(frame *funl.Frame, val funl.Value) bool {
+	// value for which filter makes RTE is not delivered
+	isMatch, errText := callFilter(frame, f.filter, val)
+	return isMatch && errText == ""
+}
+
+// apply returns event with only values passing filter,
+// false is returned if there's nothing to deliver
+func (f *eventFilter) apply(frame *funl.Frame, ev *colEvent) (*colEvent, bool) {
+	if f == nil {
+		return ev, true
+	}
+	if f.types != nil && !f.types[ev.evType] {
+		return nil, false
+	}
+	if f.filter == nil {
+		return ev, true
+	}
+	filtered := &colEvent{evType: ev.evType, seq: ev.seq, logged: ev.logged, time: ev.time, tag: ev.tag, reason: ev.reason}
+	for _, item := range ev.items {
+		// updated item is delivered if old or new value passes filter
+		if f.isMatch(frame, item.val) || (ev.evType == "updated" && f.isMatch(frame, item.oldVal)) {
+			filtered.items = append(filtered.items, item)
+		}
+	}
+	for _, change := range ev.changes {
+		filteredChange, _ := (&eventFilter{filter: f.filter}).apply(frame, change)
+		filtered.changes = append(filtered.changes, filteredChange)
+	}
+	return filtered, !filtered.isEmpty()
+}
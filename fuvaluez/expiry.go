@@ -0,0 +1,242 @@
+package fuvaluez
+
+import (
+	"container/heap"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/anssihalmeaho/funl/funl"
+)
+
+// reasonExpired is reason of deletion for items removed when those expired
+const reasonExpired = "expired"
+
+// nowMs returns current time in milliseconds since epoch
+func nowMs() int {
+	return int(time.Now().UnixNano() / int64(time.Millisecond))
+}
+
+// expiryFor returns expiry time for value put now with given time-to-live,
+// default time-to-live of col is used if ttl is 0 (0 is returned if there's no expiry)
+func (col *OpaqueCol) expiryFor(ttl int) int {
+	if ttl == 0 {
+		ttl = col.ttl
+	}
+	if ttl == 0 {
+		return 0
+	}
+	return nowMs() + ttl
+}
+
+// expiryEntry is expiry time of item in expiry queue
+type expiryEntry struct {
+	itemID string
+	expiry int // milliseconds since epoch
+	index  int // position in heap
+}
+
+// expiryHeap is min-heap of expiry times (implements heap.Interface)
+type expiryHeap []*expiryEntry
+
+func (h expiryHeap) Len() int           { return len(h) }
+func (h expiryHeap) Less(i, j int) bool { return h[i].expiry < h[j].expiry }
+
+func (h expiryHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *expiryHeap) Push(x interface{}) {
+	entry := x.(*expiryEntry)
+	entry.index = len(*h)
+	*h = append(*h, entry)
+}
+
+func (h *expiryHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	entry := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+	return entry
+}
+
+// expiredIDs returns ids of items which have expired at given time,
+// only those parts of heap are visited which have expired times
+func (h expiryHeap) expiredIDs(now int) []string {
+	var ids []string
+	var visit func(i int)
+	visit = func(i int) {
+		if i >= len(h) || h[i].expiry > now {
+			return
+		}
+		ids = append(ids, h[i].itemID)
+		visit(2*i + 1)
+		visit(2*i + 2)
+	}
+	visit(0)
+	return ids
+}
+
+// setExpiry sets expiry time of item (0 means no expiry), col needs to be locked
+func (col *OpaqueCol) setExpiry(itemID string, expiry int) {
+	entry, hadExpiry := col.expiry[itemID]
+	switch {
+	case !hadExpiry:
+		if expiry != 0 {
+			entry = &expiryEntry{itemID: itemID, expiry: expiry}
+			heap.Push(&col.expiryQueue, entry)
+			col.expiry[itemID] = entry
+		}
+	case expiry == 0:
+		heap.Remove(&col.expiryQueue, entry.index)
+		delete(col.expiry, itemID)
+	default:
+		entry.expiry = expiry
+		heap.Fix(&col.expiryQueue, entry.index)
+	}
+}
+
+// nextExpiry returns earliest expiry time (0 if none)
+func (col *OpaqueCol) nextExpiry() int {
+	if len(col.expiryQueue) == 0 {
+		return 0
+	}
+	return col.expiryQueue[0].expiry
+}
+
+// hasExpired tells whether there are expired items (not yet removed)
+func (col *OpaqueCol) hasExpired(now int) bool {
+	next := col.nextExpiry()
+	return next != 0 && now >= next
+}
+
+// isExpired tells whether item has expired (not yet removed), col needs to be read locked
+func (col *OpaqueCol) isExpired(itemID string, now int) bool {
+	entry, hasExpiry := col.expiry[itemID]
+	return hasExpiry && now >= entry.expiry
+}
+
+// visibleItems returns items which are not expired, col needs to be read locked
+func (col *OpaqueCol) visibleItems() map[string]funl.Value {
+	now := nowMs()
+	if !col.hasExpired(now) {
+		return col.Items
+	}
+	items := make(map[string]funl.Value, len(col.Items))
+	for itemID, val := range col.Items {
+		if !col.isExpired(itemID, now) {
+			items[itemID] = val
+		}
+	}
+	return items
+}
+
+// visibleItem returns value of item if it's not expired, col needs to be read locked
+func (col *OpaqueCol) visibleItem(itemID string) (funl.Value, bool) {
+	val, found := col.Items[itemID]
+	if !found {
+		return funl.Value{}, false
+	}
+	if col.isExpired(itemID, nowMs()) {
+		return funl.Value{}, false
+	}
+	return val, true
+}
+
+// expiryChange makes change to persistent storage for expiry time of item
+// (expiry is removed if it's 0)
+func (col *OpaqueCol) expiryChange(itemID string, expiry int) changeItem {
+	chItem := changeItem{
+		ChType:  expiryValue,
+		Key:     itemID,
+		ColName: col.colName,
+	}
+	if expiry != 0 {
+		chItem.Val = &funl.Value{Kind: funl.IntValue, Data: expiry}
+	}
+	return chItem
+}
+
+// sweepExpired removes expired items from col and storage (as take does),
+// 'deleted' event is given with reason 'expired'
+func (col *OpaqueCol) sweepExpired(frame *funl.Frame) {
+	now := nowMs()
+	if !col.hasExpired(now) {
+		return
+	}
+	expired := col.expiryQueue.expiredIDs(now)
+	sort.Slice(expired, func(i, j int) bool { return isOlderID(expired[i], expired[j]) })
+
+	var chlist []changeItem
+	var items []eventItem
+	for _, itemID := range expired {
+		chlist = append(chlist, changeItem{
+			ChType:  delValue,
+			Key:     itemID,
+			Val:     nil,
+			ColName: col.colName,
+		})
+		items = append(items, eventItem{id: itemID, val: col.Items[itemID]})
+	}
+	ev := newItemsEvent("deleted", items)
+	ev.reason = reasonExpired
+
+	// to storage
+	replyCh := make(chan error)
+	col.Db.Ch <- changes{Changelist: col.logChange(frame, chlist, ev), ReplyCh: replyCh}
+	if <-replyCh != nil {
+		return
+	}
+
+	col.Lock()
+	for _, itemID := range expired {
+		col.removeItem(frame, itemID)
+	}
+	col.InvalidateList()
+	col.Unlock()
+	col.latestSnapshot = nil
+
+	col.emit(frame, ev)
+	col.notifyWaiters()
+}
+
+// scheduleSweep sets timer which makes sweep request when next item expires
+func (col *OpaqueCol) scheduleSweep(frame *funl.Frame) {
+	nextExpiry := col.nextExpiry()
+	if col.sweepAt == nextExpiry {
+		return
+	}
+	if col.sweepTimer != nil {
+		col.sweepTimer.Stop()
+		col.sweepTimer = nil
+	}
+	col.sweepAt = nextExpiry
+	if nextExpiry == 0 {
+		return
+	}
+	delay := nextExpiry - nowMs()
+	if delay < 0 {
+		delay = 0
+	}
+	reqCh := col.ch
+	col.sweepTimer = time.AfterFunc(time.Duration(delay)*time.Millisecond, func() {
+		// reply is not waited (buffered so that auto-responser of closed col doesn't block)
+		reqCh <- req{reqType: sweepReq, replyCh: make(chan funl.Value, 1), frame: frame}
+	})
+}
+
+// stopSweep stops sweep timer (when col is closed)
+func (col *OpaqueCol) stopSweep() {
+	if col.sweepTimer != nil {
+		col.sweepTimer.Stop()
+		col.sweepTimer = nil
+	}
+}
+
+// parseExpiry parses expiry time read from persistent storage
+func parseExpiry(data []byte) (int, error) {
+	return strconv.Atoi(string(data))
+}
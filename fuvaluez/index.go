@@ -0,0 +1,232 @@
+package fuvaluez
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/anssihalmeaho/funl/funl"
+)
+
+// colIndex is secondary index from value found in key path to item ids
+type colIndex struct {
+	name    string
+	keyPath []funl.Value
+	entries map[string]map[string]bool
+}
+
+func newColIndex(name string, keyPath []funl.Value) *colIndex {
+	return &colIndex{
+		name:    name,
+		keyPath: keyPath,
+		entries: make(map[string]map[string]bool),
+	}
+}
+
+func (idx *colIndex) add(frame *funl.Frame, itemID string, val funl.Value) {
+	key, ok := indexKeyOf(frame, val, idx.keyPath)
+	if !ok {
+		return
+	}
+	ids, found := idx.entries[key]
+	if !found {
+		ids = make(map[string]bool)
+		idx.entries[key] = ids
+	}
+	ids[itemID] = true
+}
+
+func (idx *colIndex) remove(frame *funl.Frame, itemID string, val funl.Value) {
+	key, ok := indexKeyOf(frame, val, idx.keyPath)
+	if !ok {
+		return
+	}
+	if ids, found := idx.entries[key]; found {
+		delete(ids, itemID)
+		if len(ids) == 0 {
+			delete(idx.entries, key)
+		}
+	}
+}
+
+func (idx *colIndex) copy() *colIndex {
+	newIdx := newColIndex(idx.name, idx.keyPath)
+	for key, ids := range idx.entries {
+		newIDs := make(map[string]bool, len(ids))
+		for itemID := range ids {
+			newIDs[itemID] = true
+		}
+		newIdx.entries[key] = newIDs
+	}
+	return newIdx
+}
+
+// keyPathFromValue makes key path from list value (or single key)
+func keyPathFromValue(val funl.Value) []funl.Value {
+	if val.Kind != funl.ListValue {
+		return []funl.Value{val}
+	}
+	var keyPath []funl.Value
+	lit := funl.NewListIterator(val)
+	for {
+		nextv := lit.Next()
+		if nextv == nil {
+			break
+		}
+		keyPath = append(keyPath, *nextv)
+	}
+	return keyPath
+}
+
+// getByPath reads value from nested maps by following key path
+func getByPath(frame *funl.Frame, val funl.Value, keyPath []funl.Value) (funl.Value, bool) {
+	cur := val
+	for _, key := range keyPath {
+		if cur.Kind != funl.MapValue {
+			return funl.Value{}, false
+		}
+		getlRes := funl.HandleGetlOP(frame, []*funl.Item{
+			{Type: funl.ValueItem, Data: cur},
+			{Type: funl.ValueItem, Data: key},
+		})
+		lit := funl.NewListIterator(getlRes)
+		found := lit.Next()
+		if !found.Data.(bool) {
+			return funl.Value{}, false
+		}
+		cur = *(lit.Next())
+	}
+	return cur, true
+}
+
+func indexKeyOf(frame *funl.Frame, val funl.Value, keyPath []funl.Value) (string, bool) {
+	fieldVal, found := getByPath(frame, val, keyPath)
+	if !found {
+		return "", false
+	}
+	return valueKey(frame, fieldVal)
+}
+
+// valueKey makes string which is same for equal values,
+// values which cannot be compared (functions etc.) are not supported
+func valueKey(frame *funl.Frame, val funl.Value) (string, bool) {
+	switch val.Kind {
+	case funl.IntValue:
+		return fmt.Sprintf("i:%d", val.Data.(int)), true
+	case funl.FloatValue:
+		return fmt.Sprintf("f:%v", val.Data.(float64)), true
+	case funl.BoolValue:
+		return fmt.Sprintf("b:%v", val.Data.(bool)), true
+	case funl.StringValue:
+		s := val.Data.(string)
+		return fmt.Sprintf("s%d:%s", len(s), s), true
+	case funl.ListValue:
+		var parts []string
+		lit := funl.NewListIterator(val)
+		for {
+			nextv := lit.Next()
+			if nextv == nil {
+				break
+			}
+			part, ok := valueKey(frame, *nextv)
+			if !ok {
+				return "", false
+			}
+			parts = append(parts, part)
+		}
+		return fmt.Sprintf("l%d(%s)", len(parts), strings.Join(parts, ",")), true
+	case funl.MapValue:
+		var parts []string
+		keyvals := funl.HandleKeyvalsOP(frame, []*funl.Item{{Type: funl.ValueItem, Data: val}})
+		kvListIter := funl.NewListIterator(keyvals)
+		for {
+			nextKV := kvListIter.Next()
+			if nextKV == nil {
+				break
+			}
+			kvIter := funl.NewListIterator(*nextKV)
+			keyPart, keyOK := valueKey(frame, *(kvIter.Next()))
+			valPart, valOK := valueKey(frame, *(kvIter.Next()))
+			if !keyOK || !valOK {
+				return "", false
+			}
+			parts = append(parts, keyPart+":"+valPart)
+		}
+		sort.Strings(parts)
+		return fmt.Sprintf("m%d(%s)", len(parts), strings.Join(parts, ",")), true
+	}
+	return "", false
+}
+
+// lookupIndex returns items (id -> value) matching key in index,
+// contents of transaction/view are taken into account
+func lookupIndex(frame *funl.Frame, col *OpaqueCol, txn *OpaqueTxn, idxName string, keyVal funl.Value) (map[string]funl.Value, bool) {
+	result := make(map[string]funl.Value)
+	key, keyOK := valueKey(frame, keyVal)
+
+	if txn == nil {
+		col.RLock()
+		defer col.RUnlock()
+
+		idx, found := col.indexes[idxName]
+		if !found {
+			return nil, false
+		}
+		if keyOK {
+			for itemID := range idx.entries[key] {
+				if val, visible := col.visibleItem(itemID); visible {
+					result[itemID] = val
+				}
+			}
+		}
+		return result, true
+	}
+
+	txn.RLock()
+	defer txn.RUnlock()
+
+	// read-only view
+	if txn.isReadTxn {
+		idx, found := txn.snapIndexes[idxName]
+		if !found {
+			return nil, false
+		}
+		if keyOK {
+			for itemID := range idx.entries[key] {
+				result[itemID] = txn.snapM[itemID]
+			}
+		}
+		return result, true
+	}
+
+	// write transaction
+	idx, found := txn.col.indexes[idxName]
+	if !found {
+		return nil, false
+	}
+	if !keyOK {
+		return result, true
+	}
+	now := nowMs()
+	for itemID := range idx.entries[key] {
+		if txn.newDeleted[itemID] {
+			continue
+		}
+		if _, changed := txn.newM[itemID]; changed {
+			continue
+		}
+		if txn.col.isExpired(itemID, now) {
+			continue
+		}
+		result[itemID] = txn.col.Items[itemID]
+	}
+	for itemID, v := range txn.newM {
+		if txn.newDeleted[itemID] {
+			continue
+		}
+		if newKey, ok := indexKeyOf(frame, v, idx.keyPath); ok && newKey == key {
+			result[itemID] = v
+		}
+	}
+	return result, true
+}
@@ -0,0 +1,131 @@
+package fuvaluez
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/anssihalmeaho/funl/funl"
+)
+
+// joinOptions are options given for join
+type joinOptions struct {
+	leftCol  string
+	rightCol string
+	leftKey  []funl.Value
+	rightKey []funl.Value
+	isLeft   bool // left join (left values without pair are included)
+}
+
+func parseJoinOptions(frame *funl.Frame, optsVal funl.Value) (*joinOptions, error) {
+	opts := &joinOptions{}
+	err := forOptions(frame, optsVal, func(keyStr string, valv funl.Value) error {
+		switch keyStr {
+		case "left", "right":
+			if valv.Kind != funl.StringValue {
+				return fmt.Errorf("%s value not string: %v", keyStr, valv)
+			}
+			if keyStr == "left" {
+				opts.leftCol = valv.Data.(string)
+			} else {
+				opts.rightCol = valv.Data.(string)
+			}
+		case "left-key":
+			opts.leftKey = keyPathFromValue(valv)
+		case "right-key":
+			opts.rightKey = keyPathFromValue(valv)
+		case "kind":
+			if valv.Kind != funl.StringValue {
+				return fmt.Errorf("%s value not string: %v", keyStr, valv)
+			}
+			switch kind := valv.Data.(string); kind {
+			case "inner":
+				opts.isLeft = false
+			case "left":
+				opts.isLeft = true
+			default:
+				return fmt.Errorf("unknown join kind: %s", kind)
+			}
+		default:
+			return fmt.Errorf("unknown option: %s", keyStr)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case opts.leftCol == "" || opts.rightCol == "":
+		return nil, fmt.Errorf("left and right cols needed")
+	case opts.leftKey == nil || opts.rightKey == nil:
+		return nil, fmt.Errorf("left-key and right-key needed")
+	}
+	return opts, nil
+}
+
+// sortedIDs returns item ids in order of adding
+func sortedIDs(items map[string]funl.Value) []string {
+	ids := make([]string, 0, len(items))
+	for itemID := range items {
+		ids = append(ids, itemID)
+	}
+	sort.Slice(ids, func(i, j int) bool { return isOlderID(ids[i], ids[j]) })
+	return ids
+}
+
+// rightLookup returns function which finds ids of right side items by key,
+// index of right col is used if there's one for right key
+func (opts *joinOptions) rightLookup(frame *funl.Frame, right *OpaqueTxn) func(string) []string {
+	for _, idx := range right.snapIndexes {
+		if isSameKeyPath(frame, idx.keyPath, opts.rightKey) {
+			return func(key string) []string {
+				ids := make([]string, 0, len(idx.entries[key]))
+				for itemID := range idx.entries[key] {
+					ids = append(ids, itemID)
+				}
+				sort.Slice(ids, func(i, j int) bool { return isOlderID(ids[i], ids[j]) })
+				return ids
+			}
+		}
+	}
+	byKey := make(map[string][]string)
+	for _, itemID := range sortedIDs(right.snapM) {
+		if key, ok := indexKeyOf(frame, right.snapM[itemID], opts.rightKey); ok {
+			byKey[key] = append(byKey[key], itemID)
+		}
+	}
+	return func(key string) []string {
+		return byKey[key]
+	}
+}
+
+// runJoin joins values of cols (in consistent snapshot of cols),
+// returns list of maps with 'left' and 'right' values
+func runJoin(frame *funl.Frame, db *OpaqueDB, opts *joinOptions) (funl.Value, error) {
+	views, err := snapshotCols(frame, db, []string{opts.leftCol, opts.rightCol})
+	if err != nil {
+		return funl.Value{}, err
+	}
+	left, right := views[opts.leftCol], views[opts.rightCol]
+	lookup := opts.rightLookup(frame, right)
+
+	var results []funl.Value
+	for _, leftID := range sortedIDs(left.snapM) {
+		leftVal := left.snapM[leftID]
+		var rightIDs []string
+		if key, ok := indexKeyOf(frame, leftVal, opts.leftKey); ok {
+			rightIDs = lookup(key)
+		}
+		for _, rightID := range rightIDs {
+			results = append(results, funl.HandleMapOP(frame, []*funl.Item{
+				strItem("left"), valItem(leftVal),
+				strItem("right"), valItem(right.snapM[rightID]),
+			}))
+		}
+		if len(rightIDs) == 0 && opts.isLeft {
+			results = append(results, funl.HandleMapOP(frame, []*funl.Item{
+				strItem("left"), valItem(leftVal),
+			}))
+		}
+	}
+	return funl.MakeListOfValues(frame, results), nil
+}
@@ -0,0 +1,96 @@
+package fuvaluez
+
+import (
+	"fmt"
+
+	"github.com/anssihalmeaho/funl/funl"
+)
+
+// isKeyed tells whether col has primary key
+func (col *OpaqueCol) isKeyed() bool {
+	return col.keyPath != nil || col.keyFunc != nil
+}
+
+// keyOf returns primary key of value (as string)
+func (col *OpaqueCol) keyOf(frame *funl.Frame, val funl.Value) (key string, ok bool) {
+	if col.keyPath != nil {
+		return indexKeyOf(frame, val, col.keyPath)
+	}
+	if col.keyFunc == nil {
+		return "", false
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			key, ok = "", false
+		}
+	}()
+	keyVal := funl.HandleCallOP(frame, []*funl.Item{
+		col.keyFunc,
+		{Type: funl.ValueItem, Data: val},
+	})
+	return valueKey(frame, keyVal)
+}
+
+// checkKeys checks that primary keys remain unique if changes are applied
+func (col *OpaqueCol) checkKeys(frame *funl.Frame, newM map[string]funl.Value, newDeleted map[string]bool) string {
+	if !col.isKeyed() {
+		return ""
+	}
+	seen := make(map[string]string)
+	for itemID, v := range newM {
+		if newDeleted[itemID] {
+			continue
+		}
+		key, ok := col.keyOf(frame, v)
+		if !ok {
+			return fmt.Sprintf("value without key: %v", v)
+		}
+		if _, found := seen[key]; found {
+			return fmt.Sprintf("key conflict: %v", v)
+		}
+		seen[key] = itemID
+		if colID, found := col.keys[key]; found && colID != itemID && !newDeleted[colID] {
+			if _, changed := newM[colID]; !changed {
+				return fmt.Sprintf("key conflict: %v", v)
+			}
+		}
+	}
+	return ""
+}
+
+// noteKey keeps track of primary keys of values written in transaction
+func (txn *OpaqueTxn) noteKey(frame *funl.Frame, itemID string, val funl.Value) {
+	if !txn.col.isKeyed() {
+		return
+	}
+	if key, ok := txn.col.keyOf(frame, val); ok {
+		txn.newKeys[key] = itemID
+	}
+}
+
+// findByKey returns id of item with given primary key as seen in transaction/view
+func (txn *OpaqueTxn) findByKey(frame *funl.Frame, key string) (string, bool) {
+	col := txn.col
+	if txn.isReadTxn {
+		itemID, found := txn.snapKeys[key]
+		return itemID, found
+	}
+	isCurrent := func(itemID string) bool {
+		if txn.newDeleted[itemID] {
+			return false
+		}
+		v, changed := txn.newM[itemID]
+		if !changed {
+			return true
+		}
+		curKey, ok := col.keyOf(frame, v)
+		return ok && curKey == key
+	}
+	if itemID, found := txn.newKeys[key]; found && isCurrent(itemID) {
+		return itemID, true
+	}
+	if itemID, found := col.keys[key]; found && isCurrent(itemID) {
+		return itemID, true
+	}
+	return "", false
+}
@@ -0,0 +1,194 @@
+package fuvaluez
+
+import (
+	"fmt"
+
+	"github.com/anssihalmeaho/funl/funl"
+)
+
+// listener is procedure registered to get events of col changes
+type listener struct {
+	id          int
+	proc        *funl.Item
+	filter      *eventFilter
+	maxFailures int // listener is removed after this many consecutive failures (0 = never)
+	failures    int // consecutive failures
+}
+
+func parseListenerOptions(frame *funl.Frame, optsVal funl.Value) (*listener, error) {
+	l := &listener{filter: &eventFilter{}}
+	err := forOptions(frame, optsVal, func(keyStr string, valv funl.Value) error {
+		if handled, err := l.filter.setOption(frame, keyStr, valv); handled {
+			return err
+		}
+		switch keyStr {
+		case "max-failures":
+			if valv.Kind != funl.IntValue || valv.Data.(int) < 1 {
+				return fmt.Errorf("%s value not positive int: %v", keyStr, valv)
+			}
+			l.maxFailures = valv.Data.(int)
+		default:
+			return fmt.Errorf("unknown option: %s", keyStr)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// OpaqueListener is handle for listener returned by add-listener
+type OpaqueListener struct {
+	col *OpaqueCol
+	id  int
+}
+
+// TypeName gives type name
+func (lh *OpaqueListener) TypeName() string {
+	return "listener"
+}
+
+// Str returns value as string
+func (lh *OpaqueListener) Str() string {
+	return fmt.Sprintf("listener:%s:%d", lh.col.colName, lh.id)
+}
+
+// Equals returns equality
+func (lh *OpaqueListener) Equals(with funl.OpaqueAPI) bool {
+	other, ok := with.(*OpaqueListener)
+	if !ok {
+		return false
+	}
+	return lh.col == other.col && lh.id == other.id
+}
+
+// hasListeners tells whether anyone gets events (listeners or subscribers)
+func (col *OpaqueCol) hasListeners() bool {
+	return len(col.listeners) > 0 || col.hasSubscribers()
+}
+
+// addListener registers listener procedure (with options) and returns handle for it
+func (col *OpaqueCol) addListener(proc funl.Value, l *listener) *OpaqueListener {
+	if l == nil {
+		l = &listener{}
+	}
+	col.listenerCounter++
+	l.id = col.listenerCounter
+	l.proc = &funl.Item{Type: funl.ValueItem, Data: proc}
+	col.listeners = append(col.listeners, l)
+	return &OpaqueListener{col: col, id: l.id}
+}
+
+// removeListener removes listener, returns false if not found
+func (col *OpaqueCol) removeListener(id int) bool {
+	for i, l := range col.listeners {
+		if l.id == id {
+			col.listeners = append(col.listeners[:i:i], col.listeners[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// listenerHandles returns handles of all listeners
+func (col *OpaqueCol) listenerHandles(frame *funl.Frame) funl.Value {
+	var handles []funl.Value
+	for _, l := range col.listeners {
+		handles = append(handles, funl.Value{Kind: funl.OpaqueValue, Data: &OpaqueListener{col: col, id: l.id}})
+	}
+	return funl.MakeListOfValues(frame, handles)
+}
+
+// emit logs committed event and gives it to listeners and subscribers
+func (col *OpaqueCol) emit(frame *funl.Frame, ev *colEvent) {
+	if ev == nil {
+		return
+	}
+	col.commitLog(ev)
+	if col.hasListeners() {
+		col.callListeners(frame, ev)
+	}
+}
+
+// callListeners calls all listeners with event and sends it to subscribers
+func (col *OpaqueCol) callListeners(frame *funl.Frame, ev *colEvent) {
+	eventValue := newEventValuer(frame, ev)
+	col.publish(frame, ev, eventValue)
+	var failedIDs []int
+	for _, l := range col.listeners {
+		filtered, ok := l.filter.apply(frame, ev)
+		if !ok {
+			continue
+		}
+		event := eventValue(filtered, l.filter)
+		errText := callListener(frame, l.proc, event)
+		if errText == "" {
+			l.failures = 0
+			continue
+		}
+		col.listenerFailures++
+		l.failures++
+		handle := &OpaqueListener{col: col, id: l.id}
+		col.Db.handleListenerError(frame, funl.Value{Kind: funl.OpaqueValue, Data: handle}, event, errText)
+		if l.maxFailures > 0 && l.failures >= l.maxFailures {
+			failedIDs = append(failedIDs, l.id)
+		}
+	}
+	for _, id := range failedIDs {
+		col.removeListener(id)
+	}
+}
+
+// callListener calls listener procedure, returns error text if it made RTE
+func callListener(frame *funl.Frame, proc *funl.Item, event funl.Value) (errText string) {
+	return callWithRecover(frame, proc, event)
+}
+
+// callWithRecover calls procedure with arguments, returns error text if it made RTE
+func callWithRecover(frame *funl.Frame, proc *funl.Item, args ...funl.Value) (errText string) {
+	defer func() {
+		if r := recover(); r != nil {
+			var rtestr string
+			if err, isError := r.(error); isError {
+				rtestr = err.Error()
+			}
+			errText = fmt.Sprintf("handler made RTE: %s", rtestr)
+		}
+	}()
+
+	argsForCall := []*funl.Item{proc}
+	for _, arg := range args {
+		argsForCall = append(argsForCall, &funl.Item{Type: funl.ValueItem, Data: arg})
+	}
+	funl.HandleCallOP(frame, argsForCall)
+	return
+}
+
+// handleListenerError calls listener error handler of db (if set)
+func (db *OpaqueDB) handleListenerError(frame *funl.Frame, handle funl.Value, event funl.Value, errText string) {
+	db.RLock()
+	errHandler := db.listenerErrHandler
+	db.RUnlock()
+	if errHandler == nil {
+		return
+	}
+	callWithRecover(frame, errHandler, handle, event, funl.Value{Kind: funl.StringValue, Data: errText})
+}
+
+// newEventValuer returns function which makes FunL value of event in format of filter,
+// value of unfiltered event is made only once per format
+func newEventValuer(frame *funl.Frame, ev *colEvent) func(*colEvent, *eventFilter) funl.Value {
+	fullValues := make(map[bool]funl.Value)
+	return func(filtered *colEvent, f *eventFilter) funl.Value {
+		if filtered != ev {
+			return f.eventValue(frame, filtered)
+		}
+		v, found := fullValues[f.isRich()]
+		if !found {
+			v = f.eventValue(frame, ev)
+			fullValues[f.isRich()] = v
+		}
+		return v
+	}
+}
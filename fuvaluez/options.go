@@ -0,0 +1,207 @@
+package fuvaluez
+
+import (
+	"fmt"
+
+	"github.com/anssihalmeaho/funl/funl"
+)
+
+// forOptions calls handler for each key-value pair in options map,
+// stops in first error
+func forOptions(frame *funl.Frame, optsVal funl.Value, handler func(keyStr string, valv funl.Value) error) error {
+	if optsVal.Kind != funl.MapValue {
+		return fmt.Errorf("options not a map: %v", optsVal)
+	}
+	keyvals := funl.HandleKeyvalsOP(frame, []*funl.Item{{Type: funl.ValueItem, Data: optsVal}})
+	kvListIter := funl.NewListIterator(keyvals)
+	for {
+		nextKV := kvListIter.Next()
+		if nextKV == nil {
+			break
+		}
+		kvIter := funl.NewListIterator(*nextKV)
+		keyv := *(kvIter.Next())
+		valv := *(kvIter.Next())
+		if keyv.Kind != funl.StringValue {
+			return fmt.Errorf("option key not a string: %v", keyv)
+		}
+		if err := handler(keyv.Data.(string), valv); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// colOptions are options given for col in new-col
+type colOptions struct {
+	optionsVal funl.Value // options map as given, written to persistent storage
+	keyPath    []funl.Value
+	keyFunc    *funl.Item
+	changelog  bool
+	logMax     int // max number of events kept in change log (0 means no limit)
+	maxItems   int
+	maxBytes   int
+	ttl        int
+}
+
+func parseColOptions(frame *funl.Frame, optsVal funl.Value) (*colOptions, error) {
+	opts := &colOptions{optionsVal: optsVal}
+	err := forOptions(frame, optsVal, func(keyStr string, valv funl.Value) error {
+		switch keyStr {
+		case "key":
+			opts.keyPath = keyPathFromValue(valv)
+		case "key-func":
+			if valv.Kind != funl.FunctionValue {
+				return fmt.Errorf("%s value not func: %v", keyStr, valv)
+			}
+			opts.keyFunc = &funl.Item{Type: funl.ValueItem, Data: valv}
+		case "changelog":
+			if valv.Kind != funl.BoolValue {
+				return fmt.Errorf("%s value not bool: %v", keyStr, valv)
+			}
+			opts.changelog = valv.Data.(bool)
+		case "changelog-max":
+			if valv.Kind != funl.IntValue || valv.Data.(int) <= 0 {
+				return fmt.Errorf("%s value not positive int: %v", keyStr, valv)
+			}
+			opts.logMax = valv.Data.(int)
+		case "max-items", "max-bytes":
+			if valv.Kind != funl.IntValue || valv.Data.(int) <= 0 {
+				return fmt.Errorf("%s value not positive int: %v", keyStr, valv)
+			}
+			if keyStr == "max-items" {
+				opts.maxItems = valv.Data.(int)
+			} else {
+				opts.maxBytes = valv.Data.(int)
+			}
+		case "ttl-ms":
+			ttl, err := parseTTL(keyStr, valv)
+			if err != nil {
+				return err
+			}
+			opts.ttl = ttl
+		default:
+			return fmt.Errorf("unknown option: %s", keyStr)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if opts.keyPath != nil && opts.keyFunc != nil {
+		return nil, fmt.Errorf("both key and key-func given")
+	}
+	if opts.logMax > 0 && !opts.changelog {
+		return nil, fmt.Errorf("changelog-max given without changelog")
+	}
+	return opts, nil
+}
+
+func parseTTL(keyStr string, valv funl.Value) (int, error) {
+	if valv.Kind != funl.IntValue || valv.Data.(int) <= 0 {
+		return 0, fmt.Errorf("%s value not positive int: %v", keyStr, valv)
+	}
+	return valv.Data.(int), nil
+}
+
+// parsePutOptions parses options given for put-value, returns time-to-live (0 if not given)
+func parsePutOptions(frame *funl.Frame, optsVal funl.Value) (int, error) {
+	var ttl int
+	err := forOptions(frame, optsVal, func(keyStr string, valv funl.Value) error {
+		switch keyStr {
+		case "ttl-ms":
+			var err error
+			ttl, err = parseTTL(keyStr, valv)
+			return err
+		default:
+			return fmt.Errorf("unknown option: %s", keyStr)
+		}
+	})
+	return ttl, err
+}
+
+// transOptions are options given for trans and db-trans
+type transOptions struct {
+	tag       string // transaction tag
+	withError bool   // result is list(committed error-text) instead of bool
+}
+
+// parseTransOptions parses options given for trans and db-trans
+func parseTransOptions(frame *funl.Frame, optsVal funl.Value) (transOptions, error) {
+	var opts transOptions
+	err := forOptions(frame, optsVal, func(keyStr string, valv funl.Value) error {
+		switch keyStr {
+		case "tag":
+			if valv.Kind != funl.StringValue {
+				return fmt.Errorf("%s value not string: %v", keyStr, valv)
+			}
+			opts.tag = valv.Data.(string)
+		case "with-error":
+			if valv.Kind != funl.BoolValue {
+				return fmt.Errorf("%s value not bool: %v", keyStr, valv)
+			}
+			opts.withError = valv.Data.(bool)
+		default:
+			return fmt.Errorf("unknown option: %s", keyStr)
+		}
+		return nil
+	})
+	return opts, err
+}
+
+// transResult makes result value of trans/db-trans, error text tells
+// why changes were not committed (empty if committed or cancelled)
+func (opts transOptions) transResult(frame *funl.Frame, committed bool, errText string) funl.Value {
+	if !opts.withError {
+		return funl.Value{Kind: funl.BoolValue, Data: committed}
+	}
+	return funl.MakeListOfValues(frame, []funl.Value{
+		{Kind: funl.BoolValue, Data: committed},
+		{Kind: funl.StringValue, Data: errText},
+	})
+}
+
+// parseChangesOptions parses event filter and format options given for changes-since
+func parseChangesOptions(frame *funl.Frame, optsVal funl.Value) (*eventFilter, error) {
+	f := &eventFilter{}
+	err := forOptions(frame, optsVal, func(keyStr string, valv funl.Value) error {
+		if handled, err := f.setOption(frame, keyStr, valv); handled {
+			return err
+		}
+		return fmt.Errorf("unknown option: %s", keyStr)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// getOptions are options given for get-values
+type getOptions struct {
+	fields  *projection // nil means whole values
+	ordered bool        // values in insertion order
+}
+
+func parseGetOptions(frame *funl.Frame, optsVal funl.Value) (*getOptions, error) {
+	opts := &getOptions{}
+	err := forOptions(frame, optsVal, func(keyStr string, valv funl.Value) error {
+		switch keyStr {
+		case "fields":
+			var err error
+			opts.fields, err = parseProjection(frame, valv)
+			return err
+		case "ordered":
+			if valv.Kind != funl.BoolValue {
+				return fmt.Errorf("%s value not bool: %v", keyStr, valv)
+			}
+			opts.ordered = valv.Data.(bool)
+		default:
+			return fmt.Errorf("unknown option: %s", keyStr)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return opts, nil
+}
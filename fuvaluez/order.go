@@ -0,0 +1,90 @@
+package fuvaluez
+
+import (
+	"sort"
+
+	"github.com/anssihalmeaho/funl/funl"
+)
+
+// itemOrder keeps item ids in insertion order (ids are given in increasing order),
+// removed ids are cleaned lazily
+type itemOrder struct {
+	ids     []string
+	removed int
+}
+
+// add appends id of new item
+func (o *itemOrder) add(itemID string) {
+	o.ids = append(o.ids, itemID)
+}
+
+// remove notes removal of item, ids are compacted when there's enough removed ones,
+// new slice is made so that views sharing old slice are not affected
+func (o *itemOrder) remove(items map[string]funl.Value) {
+	o.removed++
+	if o.removed < 32 || o.removed < len(o.ids)/2 {
+		return
+	}
+	ids := make([]string, 0, len(items))
+	for _, itemID := range o.ids {
+		if _, found := items[itemID]; found {
+			ids = append(ids, itemID)
+		}
+	}
+	o.ids = ids
+	o.removed = 0
+}
+
+// reset sets order according to item ids (when items are read from storage)
+func (o *itemOrder) reset(items map[string]funl.Value) {
+	o.ids = make([]string, 0, len(items))
+	for itemID := range items {
+		o.ids = append(o.ids, itemID)
+	}
+	sort.Slice(o.ids, func(i, j int) bool { return isOlderID(o.ids[i], o.ids[j]) })
+	o.removed = 0
+}
+
+// orderedValues returns values of items in order of ids (ids not in items are skipped)
+func orderedValues(ids []string, items map[string]funl.Value) []funl.Value {
+	values := make([]funl.Value, 0, len(items))
+	for _, itemID := range ids {
+		if v, found := items[itemID]; found {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+// selectValues returns values selected by selector,
+// values are in order of ids if those are given
+func selectValues(frame *funl.Frame, sel *valueSelector, items map[string]funl.Value, indexes map[string]*colIndex, orderIDs []string) ([]funl.Value, error) {
+	selected, err := sel.selectItems(frame, items, indexes)
+	if err != nil {
+		return nil, err
+	}
+	if orderIDs != nil {
+		return orderedValues(orderIDs, selected), nil
+	}
+	values := make([]funl.Value, 0, len(selected))
+	for _, v := range selected {
+		values = append(values, v)
+	}
+	return values, nil
+}
+
+// orderedIDs returns ids of items in insertion order as seen in transaction/view
+// (may contain ids of removed items)
+func (txn *OpaqueTxn) orderedIDs() []string {
+	if txn.isReadTxn {
+		return txn.snapOrder
+	}
+	var added []string
+	for itemID := range txn.newM {
+		if _, found := txn.col.Items[itemID]; !found {
+			added = append(added, itemID)
+		}
+	}
+	sort.Slice(added, func(i, j int) bool { return isOlderID(added[i], added[j]) })
+	return append(append([]string{}, txn.col.order.ids...), added...)
+}
@@ -0,0 +1,218 @@
+package fuvaluez
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/anssihalmeaho/funl/funl"
+)
+
+// operators of pattern conditions
+var patternOps = map[string]bool{
+	"eq":     true,
+	"ne":     true,
+	"gt":     true,
+	"lt":     true,
+	"ge":     true,
+	"le":     true,
+	"in":     true,
+	"prefix": true,
+}
+
+// patternCond is condition for one field of value
+type patternCond struct {
+	keyPath []funl.Value
+	op      string
+	arg     funl.Value
+	argKeys map[string]bool // value keys of argument for eq/ne/in
+}
+
+// valuePattern is map pattern which is evaluated without calling FunL functions,
+// value matches if all conditions are true
+type valuePattern struct {
+	conds []patternCond
+}
+
+// parsePattern makes pattern from map, key is field name (or key path as list)
+// and value is either value to compare (equality) or map of operators and arguments
+func parsePattern(frame *funl.Frame, patVal funl.Value) (*valuePattern, error) {
+	pat := &valuePattern{}
+	keyvals := funl.HandleKeyvalsOP(frame, []*funl.Item{{Type: funl.ValueItem, Data: patVal}})
+	for _, kv := range listValues(keyvals) {
+		pair := listValues(kv)
+		keyPath := keyPathFromValue(pair[0])
+		ops, isOps := operatorsOf(frame, pair[1])
+		if !isOps {
+			ops = [][2]funl.Value{{{Kind: funl.StringValue, Data: "eq"}, pair[1]}}
+		}
+		for _, opAndArg := range ops {
+			cond, err := newPatternCond(frame, keyPath, opAndArg[0].Data.(string), opAndArg[1])
+			if err != nil {
+				return nil, err
+			}
+			pat.conds = append(pat.conds, cond)
+		}
+	}
+	return pat, nil
+}
+
+// operatorsOf returns operators and arguments if value is map containing only operators
+func operatorsOf(frame *funl.Frame, val funl.Value) ([][2]funl.Value, bool) {
+	if val.Kind != funl.MapValue {
+		return nil, false
+	}
+	var ops [][2]funl.Value
+	keyvals := funl.HandleKeyvalsOP(frame, []*funl.Item{{Type: funl.ValueItem, Data: val}})
+	for _, kv := range listValues(keyvals) {
+		pair := listValues(kv)
+		opName, isString := pair[0].Data.(string)
+		if !isString || !patternOps[opName] {
+			return nil, false
+		}
+		ops = append(ops, [2]funl.Value{pair[0], pair[1]})
+	}
+	return ops, len(ops) > 0
+}
+
+func newPatternCond(frame *funl.Frame, keyPath []funl.Value, op string, arg funl.Value) (patternCond, error) {
+	cond := patternCond{keyPath: keyPath, op: op, arg: arg}
+	switch op {
+	case "eq", "ne":
+		key, ok := valueKey(frame, arg)
+		if !ok {
+			return cond, fmt.Errorf("%s: value cannot be compared: %v", op, arg)
+		}
+		cond.argKeys = map[string]bool{key: true}
+	case "in":
+		if arg.Kind != funl.ListValue {
+			return cond, fmt.Errorf("%s: requires list: %v", op, arg)
+		}
+		cond.argKeys = make(map[string]bool)
+		for _, v := range listValues(arg) {
+			key, ok := valueKey(frame, v)
+			if !ok {
+				return cond, fmt.Errorf("%s: value cannot be compared: %v", op, v)
+			}
+			cond.argKeys[key] = true
+		}
+	case "prefix":
+		if arg.Kind != funl.StringValue {
+			return cond, fmt.Errorf("%s: requires string: %v", op, arg)
+		}
+	default:
+		if !isNumber(arg) && arg.Kind != funl.StringValue {
+			return cond, fmt.Errorf("%s: requires number or string: %v", op, arg)
+		}
+	}
+	return cond, nil
+}
+
+// isMatch tells whether field of value satisfies condition,
+// condition is false if value doesn't have the field
+func (cond *patternCond) isMatch(frame *funl.Frame, val funl.Value) bool {
+	fieldVal, found := getByPath(frame, val, cond.keyPath)
+	if !found {
+		return false
+	}
+	switch cond.op {
+	case "eq", "in":
+		key, ok := valueKey(frame, fieldVal)
+		return ok && cond.argKeys[key]
+	case "ne":
+		key, ok := valueKey(frame, fieldVal)
+		return !ok || !cond.argKeys[key]
+	case "prefix":
+		s, isString := fieldVal.Data.(string)
+		return isString && strings.HasPrefix(s, cond.arg.Data.(string))
+	}
+	// ordering is defined only between numbers and between strings
+	if isNumber(fieldVal) != isNumber(cond.arg) || (!isNumber(fieldVal) && fieldVal.Kind != funl.StringValue) {
+		return false
+	}
+	cmp := compareValues(fieldVal, cond.arg)
+	switch cond.op {
+	case "gt":
+		return cmp > 0
+	case "lt":
+		return cmp < 0
+	case "ge":
+		return cmp >= 0
+	case "le":
+		return cmp <= 0
+	}
+	return false
+}
+
+func (pat *valuePattern) isMatch(frame *funl.Frame, val funl.Value) bool {
+	for i := range pat.conds {
+		if !pat.conds[i].isMatch(frame, val) {
+			return false
+		}
+	}
+	return true
+}
+
+// candidates returns ids of items which may match pattern by using index
+// (of eq/in condition) with fewest entries, false is returned if no index can be used
+func (pat *valuePattern) candidates(frame *funl.Frame, indexes map[string]*colIndex) (map[string]bool, bool) {
+	var best map[string]bool
+	for _, cond := range pat.conds {
+		if cond.op != "eq" && cond.op != "in" {
+			continue
+		}
+		for _, idx := range indexes {
+			if !isSameKeyPath(frame, idx.keyPath, cond.keyPath) {
+				continue
+			}
+			ids := make(map[string]bool)
+			for key := range cond.argKeys {
+				for itemID := range idx.entries[key] {
+					ids[itemID] = true
+				}
+			}
+			if best == nil || len(ids) < len(best) {
+				best = ids
+			}
+		}
+	}
+	return best, best != nil
+}
+
+// selectItems returns ids and values of items matching pattern,
+// indexes are used if possible (nil if items are not indexed)
+func (pat *valuePattern) selectItems(frame *funl.Frame, items map[string]funl.Value, indexes map[string]*colIndex) ([]string, []funl.Value) {
+	var ids []string
+	var values []funl.Value
+	check := func(itemID string, val funl.Value) {
+		if pat.isMatch(frame, val) {
+			ids = append(ids, itemID)
+			values = append(values, val)
+		}
+	}
+	if candidateIDs, useIndex := pat.candidates(frame, indexes); useIndex {
+		for itemID := range candidateIDs {
+			if val, found := items[itemID]; found {
+				check(itemID, val)
+			}
+		}
+		return ids, values
+	}
+	for itemID, val := range items {
+		check(itemID, val)
+	}
+	return ids, values
+}
+
+func isSameKeyPath(frame *funl.Frame, path1, path2 []funl.Value) bool {
+	if len(path1) != len(path2) {
+		return false
+	}
+	for i := range path1 {
+		key1, ok1 := valueKey(frame, path1[i])
+		key2, ok2 := valueKey(frame, path2[i])
+		if !ok1 || !ok2 || key1 != key2 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,91 @@
+package fuvaluez
+
+import (
+	"fmt"
+
+	"github.com/anssihalmeaho/funl/funl"
+)
+
+// projection selects fields of map values,
+// fields are kept as tree so that nested fields are selected in one pass
+type projection struct {
+	key      funl.Value
+	whole    bool // whole field is selected (not just some nested fields)
+	children []*projection
+}
+
+// parseProjection makes projection from list of fields (key or key path as list)
+func parseProjection(frame *funl.Frame, fieldsVal funl.Value) (*projection, error) {
+	if fieldsVal.Kind != funl.ListValue {
+		return nil, fmt.Errorf("fields not a list: %v", fieldsVal)
+	}
+	root := &projection{}
+	for _, fieldVal := range listValues(fieldsVal) {
+		keyPath := keyPathFromValue(fieldVal)
+		if len(keyPath) == 0 {
+			return nil, fmt.Errorf("empty key path in fields")
+		}
+		if err := root.addPath(frame, keyPath); err != nil {
+			return nil, err
+		}
+	}
+	return root, nil
+}
+
+func (p *projection) addPath(frame *funl.Frame, keyPath []funl.Value) error {
+	keyStr, keyOK := valueKey(frame, keyPath[0])
+	if !keyOK {
+		return fmt.Errorf("invalid field key: %v", keyPath[0])
+	}
+	var child *projection
+	for _, c := range p.children {
+		if cKey, _ := valueKey(frame, c.key); cKey == keyStr {
+			child = c
+			break
+		}
+	}
+	if child == nil {
+		child = &projection{key: keyPath[0]}
+		p.children = append(p.children, child)
+	}
+	if len(keyPath) == 1 {
+		child.whole = true
+		return nil
+	}
+	return child.addPath(frame, keyPath[1:])
+}
+
+// apply returns map value with only selected fields, other than map values
+// are returned as such (nil projection returns value as such)
+func (p *projection) apply(frame *funl.Frame, val funl.Value) funl.Value {
+	if p == nil || val.Kind != funl.MapValue {
+		return val
+	}
+	var mapItems []*funl.Item
+	for _, child := range p.children {
+		fieldVal, found := getByPath(frame, val, []funl.Value{child.key})
+		if !found {
+			continue
+		}
+		if !child.whole {
+			if fieldVal.Kind != funl.MapValue {
+				continue
+			}
+			fieldVal = child.apply(frame, fieldVal)
+		}
+		mapItems = append(mapItems, valItem(child.key), valItem(fieldVal))
+	}
+	return funl.HandleMapOP(frame, mapItems)
+}
+
+// applyAll returns values with projection applied
+func (p *projection) applyAll(frame *funl.Frame, values []funl.Value) []funl.Value {
+	if p == nil {
+		return values
+	}
+	projected := make([]funl.Value, len(values))
+	for i, val := range values {
+		projected[i] = p.apply(frame, val)
+	}
+	return projected
+}
@@ -0,0 +1,249 @@
+package fuvaluez
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/anssihalmeaho/funl/funl"
+)
+
+// queryOptions are options given for query
+type queryOptions struct {
+	selector *valueSelector // nil means all values
+	sortPath []funl.Value   // key path to sort key in value
+	sortFunc *funl.Item     // function which returns sort key for value
+	desc     bool
+	limit    int // -1 means no limit
+	offset   int
+	fields   *projection // nil means whole values
+}
+
+func parseQueryOptions(frame *funl.Frame, optsVal funl.Value) (*queryOptions, error) {
+	q := &queryOptions{limit: -1}
+	err := forOptions(frame, optsVal, func(keyStr string, valv funl.Value) error {
+		switch keyStr {
+		case "filter":
+			selector, err := newValueSelector(frame, valv)
+			if err != nil {
+				return fmt.Errorf("%s: %v", keyStr, err)
+			}
+			q.selector = selector
+		case "sort-by":
+			q.sortPath = keyPathFromValue(valv)
+		case "sort-func":
+			if valv.Kind != funl.FunctionValue {
+				return fmt.Errorf("%s value not func: %v", keyStr, valv)
+			}
+			q.sortFunc = &funl.Item{Type: funl.ValueItem, Data: valv}
+		case "order":
+			if valv.Kind != funl.StringValue {
+				return fmt.Errorf("%s value not string: %v", keyStr, valv)
+			}
+			switch order := valv.Data.(string); order {
+			case "asc":
+				q.desc = false
+			case "desc":
+				q.desc = true
+			default:
+				return fmt.Errorf("unknown order: %s", order)
+			}
+		case "limit", "offset":
+			if valv.Kind != funl.IntValue || valv.Data.(int) < 0 {
+				return fmt.Errorf("%s value not non-negative int: %v", keyStr, valv)
+			}
+			if keyStr == "limit" {
+				q.limit = valv.Data.(int)
+			} else {
+				q.offset = valv.Data.(int)
+			}
+		case "fields":
+			fields, err := parseProjection(frame, valv)
+			if err != nil {
+				return err
+			}
+			q.fields = fields
+		default:
+			return fmt.Errorf("unknown option: %s", keyStr)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if q.sortPath != nil && q.sortFunc != nil {
+		return nil, fmt.Errorf("both sort-by and sort-func given")
+	}
+	return q, nil
+}
+
+// valueSelector selects values either by filter function or by map pattern
+type valueSelector struct {
+	filter  *funl.Item
+	pattern *valuePattern
+}
+
+func newValueSelector(frame *funl.Frame, filterVal funl.Value) (*valueSelector, error) {
+	switch filterVal.Kind {
+	case funl.FunctionValue:
+		return &valueSelector{filter: &funl.Item{Type: funl.ValueItem, Data: filterVal}}, nil
+	case funl.MapValue:
+		pattern, err := parsePattern(frame, filterVal)
+		if err != nil {
+			return nil, err
+		}
+		return &valueSelector{pattern: pattern}, nil
+	}
+	return nil, fmt.Errorf("not func or map: %v", filterVal)
+}
+
+// selectItems returns items (id -> value) selected, nil selector selects all items,
+// indexes (if not nil) are used for pattern
+func (sel *valueSelector) selectItems(frame *funl.Frame, items map[string]funl.Value, indexes map[string]*colIndex) (map[string]funl.Value, error) {
+	if sel == nil {
+		return items, nil
+	}
+	if sel.pattern != nil {
+		ids, values := sel.pattern.selectItems(frame, items, indexes)
+		selected := make(map[string]funl.Value, len(ids))
+		for i, itemID := range ids {
+			selected[itemID] = values[i]
+		}
+		return selected, nil
+	}
+	selected := make(map[string]funl.Value)
+	for k, v := range items {
+		filterResult := funl.HandleCallOP(frame, []*funl.Item{sel.filter, {Type: funl.ValueItem, Data: v}})
+		if filterResult.Kind != funl.BoolValue {
+			return nil, fmt.Errorf("assuming bool value")
+		}
+		if filterResult.Data.(bool) {
+			selected[k] = v
+		}
+	}
+	return selected, nil
+}
+
+// queryItem is id of item matching query with its sort key
+type queryItem struct {
+	id     string
+	key    funl.Value
+	hasKey bool
+}
+
+// run returns values of page selected by query (in sorted order),
+// indexes (if not nil) are used for pattern filter
+func (q *queryOptions) run(frame *funl.Frame, items map[string]funl.Value, indexes map[string]*colIndex) ([]funl.Value, error) {
+	ids, err := q.selectIDs(frame, items, indexes)
+	if err != nil {
+		return nil, err
+	}
+	page := make([]funl.Value, len(ids))
+	for i, itemID := range ids {
+		page[i] = q.fields.apply(frame, items[itemID])
+	}
+	return page, nil
+}
+
+// selectIDs returns ids of items of page selected by query (in sorted order),
+// items without sort key are before others in ascending order,
+// indexes (if not nil) are used for pattern filter
+func (q *queryOptions) selectIDs(frame *funl.Frame, items map[string]funl.Value, indexes map[string]*colIndex) ([]string, error) {
+	items, err := q.selector.selectItems(frame, items, indexes)
+	if err != nil {
+		return nil, err
+	}
+	var matching []queryItem
+	for k, v := range items {
+		item := queryItem{id: k}
+		switch {
+		case q.sortPath != nil:
+			item.key, item.hasKey = getByPath(frame, v, q.sortPath)
+		case q.sortFunc != nil:
+			item.key = funl.HandleCallOP(frame, []*funl.Item{q.sortFunc, {Type: funl.ValueItem, Data: v}})
+			item.hasKey = true
+		}
+		matching = append(matching, item)
+	}
+
+	sort.Slice(matching, func(i, j int) bool {
+		a, b := matching[i], matching[j]
+		cmp := 0
+		switch {
+		case a.hasKey && b.hasKey:
+			cmp = compareValues(a.key, b.key)
+		case a.hasKey:
+			cmp = 1
+		case b.hasKey:
+			cmp = -1
+		}
+		if cmp == 0 {
+			// same sort key, older item first
+			return isOlderID(a.id, b.id) != q.desc
+		}
+		return (cmp < 0) != q.desc
+	})
+
+	if q.offset >= len(matching) {
+		return []string{}, nil
+	}
+	matching = matching[q.offset:]
+	if q.limit >= 0 && q.limit < len(matching) {
+		matching = matching[:q.limit]
+	}
+	ids := make([]string, len(matching))
+	for i, item := range matching {
+		ids[i] = item.id
+	}
+	return ids, nil
+}
+
+// compareValues compares sort keys, numbers, strings and bools are compared by value,
+// other values (and values of different kinds) are ordered by kind
+func compareValues(a, b funl.Value) int {
+	if isNumber(a) && isNumber(b) {
+		af, bf := toFloat(a), toFloat(b)
+		switch {
+		case af < bf:
+			return -1
+		case af > bf:
+			return 1
+		}
+		return 0
+	}
+	if a.Kind != b.Kind {
+		if a.Kind < b.Kind {
+			return -1
+		}
+		return 1
+	}
+	switch a.Kind {
+	case funl.StringValue:
+		as, bs := a.Data.(string), b.Data.(string)
+		switch {
+		case as < bs:
+			return -1
+		case as > bs:
+			return 1
+		}
+	case funl.BoolValue:
+		ab, bb := a.Data.(bool), b.Data.(bool)
+		switch {
+		case !ab && bb:
+			return -1
+		case ab && !bb:
+			return 1
+		}
+	}
+	return 0
+}
+
+func isNumber(v funl.Value) bool {
+	return v.Kind == funl.IntValue || v.Kind == funl.FloatValue
+}
+
+func toFloat(v funl.Value) float64 {
+	if v.Kind == funl.IntValue {
+		return float64(v.Data.(int))
+	}
+	return v.Data.(float64)
+}
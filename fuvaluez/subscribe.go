@@ -0,0 +1,266 @@
+package fuvaluez
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/anssihalmeaho/funl/funl"
+)
+
+const defaultSubscribeBuffer = 100
+
+// replayBatchSize is number of events read from change log at a time in replay
+const replayBatchSize = 100
+
+// policies for full subscription buffer
+const (
+	policyBlock      = "block"
+	policyDropOldest = "drop-oldest"
+	policyDisconnect = "disconnect"
+)
+
+// subscriber gets col events asynchronously via channel
+type subscriber struct {
+	ch     chan funl.Value
+	buffer int
+	policy string
+	done   chan struct{} // closed when unsubscribed
+	filter *eventFilter
+
+	sendMutex sync.Mutex // held while sending to ch so that ch isn't closed during send
+	closed    bool       // ch is closed
+
+	fromSeq     int // replay starts after this sequence number (-1 if no replay)
+	mutex       sync.Mutex
+	replaying   bool // new events are not sent while replaying (those are read from change log)
+	replayedSeq int  // sequence number until which events are read from change log
+}
+
+func parseSubscribeOptions(frame *funl.Frame, optsVal funl.Value) (*subscriber, error) {
+	sub := &subscriber{buffer: defaultSubscribeBuffer, policy: policyDropOldest, filter: &eventFilter{}, fromSeq: -1}
+	err := forOptions(frame, optsVal, func(keyStr string, valv funl.Value) error {
+		if handled, err := sub.filter.setOption(frame, keyStr, valv); handled {
+			return err
+		}
+		switch keyStr {
+		case "buffer":
+			if valv.Kind != funl.IntValue || valv.Data.(int) < 0 {
+				return fmt.Errorf("%s value not non-negative int: %v", keyStr, valv)
+			}
+			sub.buffer = valv.Data.(int)
+		case "policy":
+			if valv.Kind != funl.StringValue {
+				return fmt.Errorf("%s value not string: %v", keyStr, valv)
+			}
+			switch policy := valv.Data.(string); policy {
+			case policyBlock, policyDropOldest, policyDisconnect:
+				sub.policy = policy
+			default:
+				return fmt.Errorf("unknown policy: %s", policy)
+			}
+		case "from-seq":
+			if valv.Kind != funl.IntValue || valv.Data.(int) < 0 {
+				return fmt.Errorf("%s value not non-negative int: %v", keyStr, valv)
+			}
+			sub.fromSeq = valv.Data.(int)
+		default:
+			return fmt.Errorf("unknown option: %s", keyStr)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if sub.buffer == 0 && sub.policy != policyBlock {
+		return nil, fmt.Errorf("buffer needed for policy %s", sub.policy)
+	}
+	return sub, nil
+}
+
+// addSubscriber makes channel for subscriber and registers it
+// (replay is started for it if from-seq was given)
+func (col *OpaqueCol) addSubscriber(frame *funl.Frame, sub *subscriber) {
+	if sub.policy == policyDisconnect {
+		// one extra place is reserved for overflow event
+		sub.ch = make(chan funl.Value, sub.buffer+1)
+	} else {
+		sub.ch = make(chan funl.Value, sub.buffer)
+	}
+	sub.done = make(chan struct{})
+	if sub.fromSeq >= 0 {
+		sub.replaying = true
+		sub.replayedSeq = sub.fromSeq
+	}
+
+	col.subsMutex.Lock()
+	col.subscribers = append(col.subscribers, sub)
+	col.subsMutex.Unlock()
+
+	if sub.replaying {
+		// replay is done in own frame of replay fiber
+		replayFrame := funl.NewTopFrameWithInterpreter(frame.Interpreter)
+		replayFrame.SetInProcCall(true)
+		go col.replay(replayFrame, sub)
+	}
+}
+
+// replay reads events from change log in batches and sends those to subscriber
+// (waits if channel is full), new events are sent after change log is read
+// to the end, subscriber is removed if reading change log fails
+func (col *OpaqueCol) replay(frame *funl.Frame, sub *subscriber) {
+	for {
+		events, err := col.changesSince(frame, sub.replayedSeq, replayBatchSize)
+		if err != nil {
+			col.unsubscribe(sub.ch)
+			return
+		}
+		if len(events) == 0 {
+			sub.mutex.Lock()
+			// events committed meanwhile are read from change log too
+			if col.lastSeq() <= sub.replayedSeq {
+				sub.replaying = false
+				sub.mutex.Unlock()
+				return
+			}
+			sub.mutex.Unlock()
+			continue
+		}
+		for _, ev := range events {
+			if filtered, ok := sub.filter.apply(frame, ev); ok {
+				if !sub.send(sub.filter.eventValue(frame, filtered)) {
+					return
+				}
+			}
+			sub.mutex.Lock()
+			sub.replayedSeq = ev.seq
+			sub.mutex.Unlock()
+		}
+	}
+}
+
+// send sends event to channel (waits if it's full),
+// returns false if subscriber is detached
+func (sub *subscriber) send(event funl.Value) bool {
+	sub.sendMutex.Lock()
+	defer sub.sendMutex.Unlock()
+	if sub.closed {
+		return false
+	}
+	select {
+	case sub.ch <- event:
+		return true
+	case <-sub.done:
+		return false
+	}
+}
+
+// detach stops sending to subscriber and closes channel,
+// done is closed first so that pending send is stopped
+func (sub *subscriber) detach() {
+	close(sub.done)
+	sub.sendMutex.Lock()
+	defer sub.sendMutex.Unlock()
+	sub.closed = true
+	close(sub.ch)
+}
+
+// unsubscribe removes subscriber, returns false if not found
+func (col *OpaqueCol) unsubscribe(ch chan funl.Value) bool {
+	col.subsMutex.Lock()
+	defer col.subsMutex.Unlock()
+	for i, sub := range col.subscribers {
+		if sub.ch == ch {
+			col.subscribers = append(col.subscribers[:i:i], col.subscribers[i+1:]...)
+			sub.detach()
+			return true
+		}
+	}
+	return false
+}
+
+// unsubscribeAll removes all subscribers (when col is closed or deleted)
+func (col *OpaqueCol) unsubscribeAll() {
+	col.subsMutex.Lock()
+	defer col.subsMutex.Unlock()
+	for _, sub := range col.subscribers {
+		sub.detach()
+	}
+	col.subscribers = nil
+}
+
+func (col *OpaqueCol) hasSubscribers() bool {
+	col.subsMutex.Lock()
+	defer col.subsMutex.Unlock()
+	return len(col.subscribers) > 0
+}
+
+// publish sends event to all subscribers
+func (col *OpaqueCol) publish(frame *funl.Frame, ev *colEvent, eventValue func(*colEvent, *eventFilter) funl.Value) {
+	col.subsMutex.Lock()
+	subs := append([]*subscriber{}, col.subscribers...)
+	col.subsMutex.Unlock()
+
+	for _, sub := range subs {
+		filtered, ok := sub.filter.apply(frame, ev)
+		if !ok {
+			continue
+		}
+		if !sub.deliver(frame, ev.seq, eventValue(filtered, sub.filter)) {
+			col.unsubscribe(sub.ch)
+		}
+	}
+}
+
+// deliver sends event to subscriber channel according to policy,
+// returns false if subscriber is to be disconnected (channel is closed
+// when it's unsubscribed)
+func (sub *subscriber) deliver(frame *funl.Frame, seq int, event funl.Value) bool {
+	sub.mutex.Lock()
+	if sub.replaying || seq <= sub.replayedSeq {
+		// event is sent in replay (from change log)
+		sub.mutex.Unlock()
+		return true
+	}
+	sub.mutex.Unlock()
+
+	switch sub.policy {
+	case policyBlock:
+		sub.send(event)
+
+	case policyDropOldest:
+		sub.sendMutex.Lock()
+		defer sub.sendMutex.Unlock()
+		if sub.closed {
+			return true
+		}
+		for {
+			select {
+			case sub.ch <- event:
+				return true
+			default:
+			}
+			select {
+			case <-sub.ch:
+			default:
+			}
+		}
+
+	case policyDisconnect:
+		sub.sendMutex.Lock()
+		defer sub.sendMutex.Unlock()
+		if sub.closed {
+			return true
+		}
+		if len(sub.ch) < sub.buffer {
+			sub.ch <- event
+			return true
+		}
+		overflow := funl.MakeListOfValues(frame, []funl.Value{
+			{Kind: funl.StringValue, Data: "overflow"},
+			funl.MakeListOfValues(frame, []funl.Value{}),
+		})
+		sub.ch <- overflow
+		return false
+	}
+	return true
+}
@@ -0,0 +1,171 @@
+package fuvaluez
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/anssihalmeaho/funl/funl"
+)
+
+// waiter is request waiting in col until its condition is fulfilled
+type waiter struct {
+	frame   *funl.Frame
+	replyCh chan funl.Value // buffered, reply is sent only once
+	errCh   chan string     // buffered
+	try     func(frame *funl.Frame) (done bool, reply funl.Value, errText string)
+	fail    func(frame *funl.Frame, text string) funl.Value // reply for timeout/close
+}
+
+// serve tries waiter condition and replies if it's fulfilled (or failed)
+func (w *waiter) serve() bool {
+	done, reply, errText := w.try(w.frame)
+	if errText != "" {
+		w.errCh <- errText
+		return true
+	}
+	if done {
+		w.replyCh <- reply
+	}
+	return done
+}
+
+// notifyWaiters is called after changes to col are committed,
+// waiters are served in order they started waiting
+func (col *OpaqueCol) notifyWaiters() {
+	if len(col.waiters) == 0 {
+		return
+	}
+	var stillWaiting []*waiter
+	for _, w := range col.waiters {
+		if !w.serve() {
+			stillWaiting = append(stillWaiting, w)
+		}
+	}
+	col.waiters = stillWaiting
+}
+
+// cancelWaiter removes waiter (if still waiting) and replies with not found
+func (col *OpaqueCol) cancelWaiter(frame *funl.Frame, replyCh chan funl.Value) {
+	for i, w := range col.waiters {
+		if w.replyCh == replyCh {
+			col.waiters = append(col.waiters[:i], col.waiters[i+1:]...)
+			w.replyCh <- w.fail(frame, "")
+			return
+		}
+	}
+}
+
+// releaseWaiters replies to all waiters when col is closed
+func (col *OpaqueCol) releaseWaiters() {
+	for _, w := range col.waiters {
+		w.replyCh <- w.fail(w.frame, "col closed")
+	}
+	col.waiters = nil
+}
+
+func notFoundReply(frame *funl.Frame, text string) funl.Value {
+	return funl.MakeListOfValues(frame, []funl.Value{{Kind: funl.BoolValue, Data: false}, {Kind: funl.StringValue, Data: text}})
+}
+
+// callFilter calls filter function for value
+func callFilter(frame *funl.Frame, filter *funl.Item, val funl.Value) (result bool, errText string) {
+	defer func() {
+		if r := recover(); r != nil {
+			var rtestr string
+			if err, isError := r.(error); isError {
+				rtestr = err.Error()
+			}
+			result, errText = false, fmt.Sprintf("handler made RTE: %s", rtestr)
+		}
+	}()
+	filterResult := funl.HandleCallOP(frame, []*funl.Item{filter, {Type: funl.ValueItem, Data: val}})
+	if filterResult.Kind != funl.BoolValue {
+		return false, "assuming bool value"
+	}
+	return filterResult.Data.(bool), ""
+}
+
+// isOlderID tells whether item id was given before other id
+func isOlderID(itemID, other string) bool {
+	id1, err1 := strconv.Atoi(itemID)
+	id2, err2 := strconv.Atoi(other)
+	if err1 != nil || err2 != nil {
+		return itemID < other
+	}
+	return id1 < id2
+}
+
+// takeWaiter makes waiter which takes oldest value matching filter
+func (col *OpaqueCol) takeWaiter(frame *funl.Frame, filterVal funl.Value, replyCh chan funl.Value, errCh chan string) *waiter {
+	filter := &funl.Item{Type: funl.ValueItem, Data: filterVal}
+	try := func(frame *funl.Frame) (bool, funl.Value, string) {
+		var matchID string
+		for k, v := range col.Items {
+			if matchID != "" && !isOlderID(k, matchID) {
+				continue
+			}
+			isMatch, errText := callFilter(frame, filter, v)
+			if errText != "" {
+				return false, funl.Value{}, errText
+			}
+			if isMatch {
+				matchID = k
+			}
+		}
+		if matchID == "" {
+			return false, funl.Value{}, ""
+		}
+		val, taken := col.takeItem(frame, matchID)
+		if !taken {
+			return false, funl.Value{}, ""
+		}
+		return true, funl.MakeListOfValues(frame, []funl.Value{{Kind: funl.BoolValue, Data: true}, val}), ""
+	}
+	return &waiter{frame: frame, replyCh: replyCh, errCh: errCh, try: try, fail: notFoundReply}
+}
+
+// awaitWaiter makes waiter which waits until predicate is true for col contents
+func (col *OpaqueCol) awaitWaiter(frame *funl.Frame, predVal funl.Value, replyCh chan funl.Value, errCh chan string) *waiter {
+	pred := &funl.Item{Type: funl.ValueItem, Data: predVal}
+	try := func(frame *funl.Frame) (bool, funl.Value, string) {
+		if col.AsList == nil {
+			col.MakeList(frame)
+		}
+		isTrue, errText := callFilter(frame, pred, *col.AsList)
+		return isTrue, funl.Value{Kind: funl.BoolValue, Data: true}, errText
+	}
+	fail := func(frame *funl.Frame, text string) funl.Value {
+		return funl.Value{Kind: funl.BoolValue, Data: false}
+	}
+	return &waiter{frame: frame, replyCh: replyCh, errCh: errCh, try: try, fail: fail}
+}
+
+// waitForReply waits reply for waiter request, if timeout (in milliseconds)
+// expires before that waiter is cancelled
+func waitForReply(frame *funl.Frame, col *OpaqueCol, replyCh chan funl.Value, errCh chan string, timeout int) (funl.Value, string) {
+	var timeoutCh <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(time.Duration(timeout) * time.Millisecond)
+		defer timer.Stop()
+		timeoutCh = timer.C
+	}
+	select {
+	case retVal := <-replyCh:
+		return retVal, ""
+	case errText := <-errCh:
+		return funl.Value{}, errText
+	case <-timeoutCh:
+	}
+
+	// waiter may get reply still before it's cancelled
+	ackCh := make(chan funl.Value)
+	col.ch <- req{reqType: cancelWaitReq, replyCh: ackCh, waitCh: replyCh, frame: frame}
+	<-ackCh
+	select {
+	case retVal := <-replyCh:
+		return retVal, ""
+	case errText := <-errCh:
+		return funl.Value{}, errText
+	}
+}